@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// accessTemplate is a custom access log format like the log_format of
+// nginx, e.g. "$remote_addr $host \"$request\" $status $location $duration"
+type accessTemplate []accessField
+
+// accessField is a literal text of the template or the value of a variable
+type accessField func(e *accessLogEntry, r *http.Request) string
+
+// accessVariables are the variables of access log templates, request
+// headers are available as $http_<name> like $http_x_forwarded_for
+var accessVariables = map[string]accessField{
+	"remote_addr":     func(e *accessLogEntry, _ *http.Request) string { return e.ClientIP },
+	"remote_user":     func(e *accessLogEntry, _ *http.Request) string { return e.User },
+	"listener":        func(e *accessLogEntry, _ *http.Request) string { return e.Listener },
+	"time_local":      func(e *accessLogEntry, _ *http.Request) string { return e.Time.Format("02/Jan/2006:15:04:05 -0700") },
+	"time_iso8601":    func(e *accessLogEntry, _ *http.Request) string { return e.Time.Format(time.RFC3339) },
+	"request":         func(e *accessLogEntry, _ *http.Request) string { return e.Method + " " + e.uri + " " + e.Proto },
+	"request_method":  func(e *accessLogEntry, _ *http.Request) string { return e.Method },
+	"request_uri":     func(e *accessLogEntry, _ *http.Request) string { return e.uri },
+	"uri":             func(e *accessLogEntry, _ *http.Request) string { return e.Path },
+	"args":            func(e *accessLogEntry, _ *http.Request) string { return e.Query },
+	"host":            func(e *accessLogEntry, _ *http.Request) string { return e.Host },
+	"server_protocol": func(e *accessLogEntry, _ *http.Request) string { return e.Proto },
+	"status":          func(e *accessLogEntry, _ *http.Request) string { return strconv.Itoa(e.Status) },
+	"body_bytes_sent": func(e *accessLogEntry, _ *http.Request) string { return strconv.FormatInt(e.Bytes, 10) },
+	"location":        func(e *accessLogEntry, _ *http.Request) string { return e.Target },
+	"http_referer":    func(e *accessLogEntry, _ *http.Request) string { return e.Referer },
+	"http_user_agent": func(e *accessLogEntry, _ *http.Request) string { return e.UserAgent },
+	"request_id":      func(e *accessLogEntry, _ *http.Request) string { return e.RequestID },
+	// duration is the time of the request in seconds with millisecond
+	// resolution like the request_time of nginx
+	"duration": func(e *accessLogEntry, _ *http.Request) string {
+		return strconv.FormatFloat(e.LatencyMS/1000, 'f', 3, 64)
+	},
+}
+
+// parseAccessTemplate splits the template into its text and the variables
+// written as $name or ${name}
+func parseAccessTemplate(s string) (accessTemplate, error) {
+	var t accessTemplate
+	for s != "" {
+		i := strings.IndexByte(s, '$')
+		if i < 0 {
+			t = append(t, literal(s))
+			break
+		}
+		if i > 0 {
+			t = append(t, literal(s[:i]))
+		}
+		s = s[i+1:]
+		var name string
+		if strings.HasPrefix(s, "{") {
+			end := strings.IndexByte(s, '}')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated variable ${%s in access log format", s[1:])
+			}
+			name, s = s[1:end], s[end+1:]
+		} else {
+			end := strings.IndexFunc(s, func(c rune) bool {
+				return !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_')
+			})
+			if end < 0 {
+				end = len(s)
+			}
+			name, s = s[:end], s[end:]
+		}
+		field, err := accessVariable(name)
+		if err != nil {
+			return nil, err
+		}
+		t = append(t, field)
+	}
+	return t, nil
+}
+
+func accessVariable(name string) (accessField, error) {
+	if field, ok := accessVariables[name]; ok {
+		return field, nil
+	}
+	if header, ok := strings.CutPrefix(name, "http_"); ok && header != "" {
+		header = http.CanonicalHeaderKey(strings.ReplaceAll(header, "_", "-"))
+		if addressHeaders[header] {
+			return func(e *accessLogEntry, r *http.Request) string {
+				return anonymizeAddresses(e.anonymize, r.Header.Get(header))
+			}, nil
+		}
+		return func(_ *accessLogEntry, r *http.Request) string { return r.Header.Get(header) }, nil
+	}
+	return nil, fmt.Errorf("unknown variable $%s in access log format", name)
+}
+
+func literal(s string) accessField {
+	return func(*accessLogEntry, *http.Request) string { return s }
+}
+
+// format returns the line of the request, empty values are written as -
+func (t accessTemplate) format(e *accessLogEntry, r *http.Request) []byte {
+	var b strings.Builder
+	for _, field := range t {
+		// literals are never empty
+		v := field(e, r)
+		if v == "" {
+			v = "-"
+		}
+		b.WriteString(v)
+	}
+	b.WriteByte('\n')
+	return []byte(b.String())
+}
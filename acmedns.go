@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/lego"
+	"github.com/go-acme/lego/v4/providers/dns/cloudflare"
+	"github.com/go-acme/lego/v4/providers/dns/rfc2136"
+	"github.com/go-acme/lego/v4/providers/dns/route53"
+	"github.com/go-acme/lego/v4/registration"
+)
+
+const (
+	// dnsRenewBefore is the remaining lifetime a certificate is renewed at
+	dnsRenewBefore = 30 * 24 * time.Hour
+	// dnsCheckInterval is the interval the certificate is checked for renewal
+	dnsCheckInterval = 12 * time.Hour
+	// dnsRetryInterval is the time to wait after a failed attempt
+	dnsRetryInterval = time.Hour
+)
+
+// dnsIssuer obtains a single certificate for all hosts with DNS-01 challenges,
+// which unlike the other challenges can be used for wildcard names. The
+// account and the certificate are kept in the cache directory.
+type dnsIssuer struct {
+	dns       challenge.Provider
+	hosts     []string
+	cache     string
+	email     string
+	directory string
+
+	cert atomic.Pointer[tls.Certificate]
+}
+
+// acmeUser is the ACME account of the issuer
+type acmeUser struct {
+	email        string
+	key          crypto.PrivateKey
+	Registration *registration.Resource `json:"registration"`
+}
+
+func (u *acmeUser) GetEmail() string                        { return u.email }
+func (u *acmeUser) GetRegistration() *registration.Resource { return u.Registration }
+func (u *acmeUser) GetPrivateKey() crypto.PrivateKey        { return u.key }
+
+// dnsProvider creates the DNS provider, the credentials are read from the
+// environment variables documented by lego for each provider
+func dnsProvider(name string) (challenge.Provider, error) {
+	switch name {
+	case "cloudflare":
+		return cloudflare.NewDNSProvider()
+	case "route53":
+		return route53.NewDNSProvider()
+	case "rfc2136":
+		return rfc2136.NewDNSProvider()
+	}
+	return nil, fmt.Errorf("unknown dns provider %q, possible values are cloudflare, route53 and rfc2136", name)
+}
+
+func newDNSIssuer(c acmeConfig, hosts []string) (*dnsIssuer, error) {
+	provider, err := dnsProvider(c.DNSProvider)
+	if err != nil {
+		return nil, err
+	}
+	i := &dnsIssuer{
+		dns:       provider,
+		hosts:     slices.Sorted(slices.Values(hosts)),
+		cache:     c.Cache,
+		email:     c.Email,
+		directory: c.DirectoryURL,
+	}
+	if i.directory == "" {
+		i.directory = lego.LEDirectoryProduction
+	}
+	cert, err := tls.LoadX509KeyPair(i.path("dns01.crt"), i.path("dns01.key"))
+	switch {
+	case err == nil:
+		i.cert.Store(&cert)
+	case !errors.Is(err, os.ErrNotExist):
+		tlsLog.Warnf("could not load cached certificate, requesting a new one: %v", err)
+	}
+	return i, nil
+}
+
+func (i *dnsIssuer) path(name string) string {
+	return filepath.Join(i.cache, name)
+}
+
+// getCertificate returns the certificate for the TLS listener
+func (i *dnsIssuer) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert := i.cert.Load()
+	if cert == nil {
+		return nil, fmt.Errorf("acme: certificate for %s not obtained yet", strings.Join(i.hosts, ", "))
+	}
+	return cert, nil
+}
+
+// run obtains the certificate if there is none for the current hosts and
+// renews it until the context is done
+func (i *dnsIssuer) run(ctx context.Context) {
+	for {
+		wait := dnsCheckInterval
+		if i.needsCertificate() {
+			if err := i.obtain(); err != nil {
+				tlsLog.Errorf("could not obtain certificate for %s: %v", strings.Join(i.hosts, ", "), err)
+				wait = dnsRetryInterval
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// needsCertificate reports if the certificate is missing, does not cover
+// the hosts or is about to expire
+func (i *dnsIssuer) needsCertificate() bool {
+	cert := i.cert.Load()
+	if cert == nil {
+		return true
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return true
+		}
+	}
+	names := slices.Sorted(slices.Values(leaf.DNSNames))
+	return !slices.Equal(names, i.hosts) || time.Until(leaf.NotAfter) < dnsRenewBefore
+}
+
+func (i *dnsIssuer) obtain() error {
+	user, err := i.account()
+	if err != nil {
+		return err
+	}
+	config := lego.NewConfig(user)
+	config.CADirURL = i.directory
+	config.Certificate.KeyType = certcrypto.EC256
+	client, err := lego.NewClient(config)
+	if err != nil {
+		return err
+	}
+	if err := client.Challenge.SetDNS01Provider(i.dns); err != nil {
+		return err
+	}
+	if user.Registration == nil {
+		reg, err := client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+		if err != nil {
+			return fmt.Errorf("could not register acme account: %w", err)
+		}
+		user.Registration = reg
+		data, err := json.Marshal(user)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(i.path("dns01+account.json"), data, 0o600); err != nil {
+			return err
+		}
+	}
+
+	tlsLog.Infof("requesting certificate for %s", strings.Join(i.hosts, ", "))
+	res, err := client.Certificate.Obtain(certificate.ObtainRequest{Domains: i.hosts, Bundle: true})
+	if err != nil {
+		return err
+	}
+	cert, err := tls.X509KeyPair(res.Certificate, res.PrivateKey)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(i.path("dns01.key"), res.PrivateKey, 0o600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(i.path("dns01.crt"), res.Certificate, 0o600); err != nil {
+		return err
+	}
+	i.cert.Store(&cert)
+	tlsLog.Infof("obtained certificate for %s valid until %s", strings.Join(i.hosts, ", "), cert.Leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// account loads the account from the cache or creates a new key, the
+// account is registered on first use
+func (i *dnsIssuer) account() (*acmeUser, error) {
+	if err := os.MkdirAll(i.cache, 0o700); err != nil {
+		return nil, err
+	}
+	user := &acmeUser{email: i.email}
+	keyFile := i.path("dns01+account.key")
+	data, err := os.ReadFile(keyFile)
+	if errors.Is(err, os.ErrNotExist) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+		if err := os.WriteFile(keyFile, data, 0o600); err != nil {
+			return nil, err
+		}
+		user.key = key
+		return user, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user.key, err = certcrypto.ParsePEMPrivateKey(data); err != nil {
+		return nil, fmt.Errorf("invalid account key %s: %w", keyFile, err)
+	}
+	data, err = os.ReadFile(i.path("dns01+account.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return user, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, user); err != nil {
+		return nil, fmt.Errorf("invalid account %s: %w", i.path("dns01+account.json"), err)
+	}
+	return user, nil
+}
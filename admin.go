@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// adminRoutes returns the handler of the internal admin listener
+func (app *application) adminRoutes() http.Handler {
+	// ids containing slashes, e.g. of imported rules, are sent encoded
+	r := mux.NewRouter().UseEncodedPath()
+	r.Use(app.loggingMiddleware)
+	r.Use(app.recoverPanic)
+	r.HandleFunc("/canary", app.canaryListHandler).Methods(http.MethodGet)
+	r.HandleFunc("/canary/{id}", app.canarySetHandler).Methods(http.MethodPut, http.MethodPost)
+	r.HandleFunc("/maintenance", app.maintenanceGetHandler).Methods(http.MethodGet)
+	r.HandleFunc("/maintenance", app.maintenanceSetHandler).Methods(http.MethodPut, http.MethodPost)
+	r.HandleFunc("/rules", app.storeListHandler).Methods(http.MethodGet)
+	r.HandleFunc("/rules/{id}", app.storePutHandler).Methods(http.MethodPut)
+	r.HandleFunc("/rules/{id}", app.storeDeleteHandler).Methods(http.MethodDelete)
+	r.HandleFunc("/rules/{id}/enabled", app.enabledSetHandler).Methods(http.MethodPut, http.MethodPost)
+	r.HandleFunc("/hits", app.hitsHandler).Methods(http.MethodGet)
+	r.HandleFunc("/import", app.importHandler).Methods(http.MethodPost)
+	r.Handle("/metrics", promhttp.Handler()).Methods(http.MethodGet)
+	r.HandleFunc("/debug/stats", app.statsHandler).Methods(http.MethodGet)
+	if app.config().PProf {
+		r.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		r.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		r.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		r.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		r.PathPrefix("/debug/pprof/").HandlerFunc(pprof.Index)
+	}
+	return r
+}
+
+type canaryStatus struct {
+	ID      string `json:"id"`
+	Target  string `json:"target"`
+	Percent int    `json:"percent"`
+}
+
+func (app *application) canaryListHandler(w http.ResponseWriter, _ *http.Request) {
+	canaries := []canaryStatus{}
+	rules := app.config().Rules
+	for i := range rules {
+		ru := &rules[i]
+		if ru.Canary != nil {
+			canaries = append(canaries, ru.Canary.status(ru.ID))
+		}
+	}
+	app.writeJSON(w, http.StatusOK, canaries)
+}
+
+func (app *application) canarySetHandler(w http.ResponseWriter, r *http.Request) {
+	id := ruleID(r)
+	ru := findRule(app.config().Rules, id)
+	if ru == nil || ru.Canary == nil {
+		http.Error(w, fmt.Sprintf("no canary rule with id %q", id), http.StatusNotFound)
+		return
+	}
+	percent, err := strconv.Atoi(r.FormValue("percent"))
+	if err != nil || percent < 0 || percent > 100 {
+		http.Error(w, "percent must be a number between 0 and 100", http.StatusBadRequest)
+		return
+	}
+	old := ru.Canary.setPercent(percent)
+	log.Infof("canary of rule %s changed from %d%% to %d%%", id, old, percent)
+	app.writeJSON(w, http.StatusOK, ru.Canary.status(id))
+}
+
+type enabledStatus struct {
+	ID      string `json:"id"`
+	Enabled bool   `json:"enabled"`
+}
+
+// enabledSetHandler enables or disables a rule until the next restart, the
+// state is kept on reloads unless enabled is changed in the config
+func (app *application) enabledSetHandler(w http.ResponseWriter, r *http.Request) {
+	id := ruleID(r)
+	ru := findRule(app.config().Rules, id)
+	if ru == nil {
+		http.Error(w, fmt.Sprintf("no rule with id %q", id), http.StatusNotFound)
+		return
+	}
+	enabled, err := strconv.ParseBool(r.FormValue("enabled"))
+	if err != nil {
+		http.Error(w, "enabled must be true or false", http.StatusBadRequest)
+		return
+	}
+	if ru.disabled.Swap(!enabled) == enabled {
+		if enabled {
+			log.Infof("rule %s enabled", id)
+		} else {
+			log.Infof("rule %s disabled", id)
+		}
+	}
+	app.writeJSON(w, http.StatusOK, enabledStatus{ID: id, Enabled: enabled})
+}
+
+// ruleID returns the decoded id of the request path
+func ruleID(r *http.Request) string {
+	id := mux.Vars(r)["id"]
+	if decoded, err := url.PathUnescape(id); err == nil {
+		return decoded
+	}
+	return id
+}
+
+func (app *application) writeJSON(w http.ResponseWriter, status int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		log.Errorf("could not write json response: %v", err)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+)
+
+const (
+	// anonymizeTruncate removes the host part of client addresses,
+	// anonymizeHash replaces them with a hash using a daily salt
+	anonymizeTruncate = "truncate"
+	anonymizeHash     = "hash"
+	saltRotation      = 24 * time.Hour
+)
+
+func validateAnonymize(mode string) error {
+	switch mode {
+	case "", anonymizeTruncate, anonymizeHash:
+		return nil
+	}
+	return fmt.Errorf("invalid ip anonymization %q, expected truncate or hash", mode)
+}
+
+// anonymizeIP truncates IPv4 addresses to /24 and IPv6 addresses to /48 or
+// hashes them, addresses that do not parse like those of unix sockets are
+// returned as they are
+func anonymizeIP(mode, addr string) string {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return addr
+	}
+	switch mode {
+	case anonymizeTruncate:
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4.Mask(net.CIDRMask(24, 32)).String()
+		}
+		return ip.Mask(net.CIDRMask(48, 128)).String()
+	case anonymizeHash:
+		mac := hmac.New(sha256.New, ipSalt.current())
+		mac.Write(ip)
+		return hex.EncodeToString(mac.Sum(nil)[:8])
+	}
+	return addr
+}
+
+// addressHeaders carry client addresses anonymized in access log templates
+var addressHeaders = map[string]bool{
+	"X-Forwarded-For":  true,
+	"X-Real-Ip":        true,
+	"Forwarded":        true,
+	"True-Client-Ip":   true,
+	"Cf-Connecting-Ip": true,
+}
+
+// anonymizeAddresses anonymizes the addresses of a forwarding header like
+// "192.0.2.1, 198.51.100.2" or "for=192.0.2.1;proto=https"
+func anonymizeAddresses(mode, value string) string {
+	if mode == "" || value == "" {
+		return value
+	}
+	elements := strings.Split(value, ",")
+	for i, element := range elements {
+		pairs := strings.Split(element, ";")
+		for j, pair := range pairs {
+			key, v, ok := strings.Cut(pair, "=")
+			if !ok {
+				pairs[j] = anonymizeHostPort(mode, pair)
+				continue
+			}
+			switch strings.ToLower(strings.TrimSpace(key)) {
+			case "for", "by":
+				pairs[j] = key + "=" + anonymizeHostPort(mode, v)
+			}
+		}
+		elements[i] = strings.Join(pairs, ";")
+	}
+	return strings.Join(elements, ",")
+}
+
+// anonymizeHostPort anonymizes an address with optional port, brackets and
+// quotes, keeping the surrounding spaces
+func anonymizeHostPort(mode, s string) string {
+	trimmed := strings.TrimSpace(s)
+	lead := s[:strings.Index(s, trimmed)]
+	addr := strings.Trim(trimmed, `"`)
+	quoted := addr != trimmed
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = strings.Trim(addr, "[]"), ""
+	}
+	anonymized := anonymizeIP(mode, host)
+	if port != "" {
+		anonymized = net.JoinHostPort(anonymized, port)
+	} else if strings.HasPrefix(addr, "[") {
+		anonymized = "[" + anonymized + "]"
+	}
+	if quoted {
+		anonymized = `"` + anonymized + `"`
+	}
+	return lead + anonymized + s[len(lead)+len(trimmed):]
+}
+
+// rotatingSalt is a random salt replaced every saltRotation, so the hashes
+// of an address can only be correlated within a day
+type rotatingSalt struct {
+	mu     sync.Mutex
+	period time.Time
+	salt   []byte
+}
+
+var ipSalt rotatingSalt
+
+func (s *rotatingSalt) current() []byte {
+	period := time.Now().Truncate(saltRotation)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !period.Equal(s.period) {
+		s.salt = make([]byte, 32)
+		_, _ = rand.Read(s.salt)
+		s.period = period
+	}
+	return s.salt
+}
+
+// anonymizingProcessor replaces the client addresses otelhttp records in
+// the spans of requests
+type anonymizingProcessor struct {
+	mode string
+}
+
+func (p anonymizingProcessor) OnStart(_ context.Context, s sdktrace.ReadWriteSpan) {
+	for _, kv := range s.Attributes() {
+		switch kv.Key {
+		case semconv.ClientAddressKey, semconv.NetworkPeerAddressKey:
+			s.SetAttributes(attribute.String(string(kv.Key), anonymizeIP(p.mode, kv.Value.AsString())))
+		}
+	}
+}
+
+func (anonymizingProcessor) OnEnd(sdktrace.ReadOnlySpan)      {}
+func (anonymizingProcessor) Shutdown(context.Context) error   { return nil }
+func (anonymizingProcessor) ForceFlush(context.Context) error { return nil }
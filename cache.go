@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// setCacheHeaders sets Cache-Control and a matching Expires header for
+// HTTP/1.0 caches on redirect responses. The rule value overrides the
+// global one.
+func (cfg *config) setCacheHeaders(w http.ResponseWriter, ru *rule) {
+	value := cfg.CacheControl
+	if ru != nil && ru.CacheControl != "" {
+		value = ru.CacheControl
+	}
+	if value == "" {
+		return
+	}
+	w.Header().Set("Cache-Control", value)
+	if expires, ok := cacheExpires(value, time.Now()); ok {
+		w.Header().Set("Expires", expires.UTC().Format(http.TimeFormat))
+	}
+}
+
+// cacheExpires returns the expiry time derived from the Cache-Control value
+func cacheExpires(value string, now time.Time) (time.Time, bool) {
+	for _, directive := range strings.Split(value, ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-store", directive == "no-cache":
+			return time.Unix(0, 0), true
+		case strings.HasPrefix(directive, "max-age="):
+			seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+			if err != nil {
+				return time.Time{}, false
+			}
+			return now.Add(time.Duration(seconds) * time.Second), true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const (
+	deviceAny     = ""
+	deviceMobile  = "mobile"
+	deviceDesktop = "desktop"
+	deviceIOS     = "ios"
+	deviceAndroid = "android"
+)
+
+var (
+	iosRegex    = regexp.MustCompile(`iPhone|iPad|iPod`)
+	mobileRegex = regexp.MustCompile(`Mobi|Android|iPhone|iPad|iPod|Opera Mini|IEMobile|BlackBerry|Windows Phone`)
+)
+
+// matchesDevice reports if the user agent belongs to the device class
+func matchesDevice(device, userAgent string) bool {
+	switch device {
+	case deviceMobile:
+		return mobileRegex.MatchString(userAgent)
+	case deviceDesktop:
+		return !mobileRegex.MatchString(userAgent)
+	case deviceIOS:
+		return iosRegex.MatchString(userAgent)
+	case deviceAndroid:
+		return strings.Contains(userAgent, "Android")
+	}
+	return true
+}
+
+const (
+	matchAll = "all"
+	matchAny = "any"
+)
+
+// headerCondition matches if any value of the request header matches the
+// regex
+type headerCondition struct {
+	Name  string `yaml:"name,omitempty"`
+	Regex string `yaml:"regex,omitempty"`
+
+	re *regexp.Regexp
+}
+
+func (hc *headerCondition) matches(r *http.Request) bool {
+	for _, v := range r.Header.Values(hc.Name) {
+		if hc.re.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesHeaders combines the header conditions, either all or any of them
+// have to match
+func matchesHeaders(conditions []headerCondition, mode string, r *http.Request) bool {
+	if len(conditions) == 0 {
+		return true
+	}
+	for i := range conditions {
+		matched := conditions[i].matches(r)
+		if mode == matchAny && matched {
+			return true
+		}
+		if mode != matchAny && !matched {
+			return false
+		}
+	}
+	return mode != matchAny
+}
+
+// prepareConditions validates and compiles the request conditions of the
+// rule
+func (ru *rule) prepareConditions() error {
+	switch ru.Device {
+	case deviceAny, deviceMobile, deviceDesktop, deviceIOS, deviceAndroid:
+	default:
+		return fmt.Errorf("invalid device %q", ru.Device)
+	}
+	if ru.UserAgent != "" {
+		re, err := regexp.Compile(ru.UserAgent)
+		if err != nil {
+			return fmt.Errorf("invalid user agent regex %q: %w", ru.UserAgent, err)
+		}
+		ru.userAgent = re
+	}
+	// an empty mode matches all like matchesHeaders
+	switch ru.HeadersMatch {
+	case "", matchAll, matchAny:
+	default:
+		return fmt.Errorf("headers_match must be %s or %s", matchAll, matchAny)
+	}
+	for i := range ru.Headers {
+		hc := &ru.Headers[i]
+		if hc.Name == "" {
+			return fmt.Errorf("header condition #%d has no name", i+1)
+		}
+		re, err := regexp.Compile(hc.Regex)
+		if err != nil {
+			return fmt.Errorf("invalid regex %q for header %s: %w", hc.Regex, hc.Name, err)
+		}
+		hc.re = re
+	}
+	if ru.Expr != "" {
+		prg, err := compileExpr(ru.Expr)
+		if err != nil {
+			return err
+		}
+		ru.expr = prg
+	}
+	return nil
+}
+
+// hasConditions reports if the rule has request conditions
+func (ru *rule) hasConditions() bool {
+	return ru.Device != deviceAny || ru.userAgent != nil || len(ru.Cookies) > 0 || len(ru.Headers) > 0 || ru.expr != nil ||
+		len(ru.Listeners) > 0
+}
+
+// matchesCookies reports if the request has all cookies. An empty value
+// only requires the cookie to be present.
+func matchesCookies(cookies map[string]string, r *http.Request) bool {
+	for name, value := range cookies {
+		c, err := r.Cookie(name)
+		if err != nil {
+			return false
+		}
+		if value != "" && c.Value != value {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesConditions reports if the request fulfills all conditions of the
+// rule
+func (ru *rule) matchesConditions(r *http.Request) bool {
+	if len(ru.Listeners) > 0 && !slices.Contains(ru.Listeners, listenerName(r)) {
+		return false
+	}
+	ua := r.UserAgent()
+	if !matchesDevice(ru.Device, ua) {
+		return false
+	}
+	if ru.userAgent != nil && !ru.userAgent.MatchString(ua) {
+		return false
+	}
+	if !matchesCookies(ru.Cookies, r) {
+		return false
+	}
+	if !matchesHeaders(ru.Headers, ru.HeadersMatch, r) {
+		return false
+	}
+	return ru.expr == nil || ru.matchesExpr(r)
+}
@@ -0,0 +1,958 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"go.yaml.in/yaml/v3"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	defaultGracefulTimeout   = 5 * time.Second
+	defaultReadTimeout       = 30 * time.Second
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultWriteTimeout      = 30 * time.Second
+	defaultIdleTimeout       = 2 * time.Minute
+	envPrefix                = "REDIRECTOR_"
+)
+
+const (
+	fallbackRedirect  = "redirect"
+	fallbackNotFound  = "404"
+	fallbackNoContent = "204"
+	fallbackPage      = "page"
+
+	trailingSlashStrict = ""
+	trailingSlashIgnore = "ignore"
+	trailingSlashStrip  = "strip"
+	trailingSlashAdd    = "add"
+
+	accessFormatCombined = "combined"
+	accessFormatJSON     = "json"
+
+	canonicalHostNone     = ""
+	canonicalHostStripWWW = "strip-www"
+	canonicalHostAddWWW   = "add-www"
+)
+
+// config holds all settings of the redirector. It is read from the optional
+// config file given with -config, command line flags override its values.
+type config struct {
+	Listen            listenConfig       `yaml:"listen"`
+	TLS               tlsConfig          `yaml:"tls"`
+	Listeners         []listenerConfig   `yaml:"listeners"`
+	TrustedProxies    []string           `yaml:"trusted_proxies"`
+	RequestIDHeader   string             `yaml:"request_id_header"`
+	HealthPath        string             `yaml:"health_path"`
+	LivePath          string             `yaml:"live_path"`
+	ReadyPath         string             `yaml:"ready_path"`
+	PProf             bool               `yaml:"pprof"`
+	Redirect          string             `yaml:"redirect"`
+	Status            int                `yaml:"status"`
+	PreservePath      bool               `yaml:"preserve_path"`
+	PreserveQuery     bool               `yaml:"preserve_query"`
+	Fallback          string             `yaml:"fallback"`
+	FallbackPage      string             `yaml:"fallback_page"`
+	Methods           []string           `yaml:"methods"`
+	IgnoreCase        bool               `yaml:"ignore_case"`
+	TrailingSlash     string             `yaml:"trailing_slash"`
+	CanonicalHost     string             `yaml:"canonical_host"`
+	Headers           map[string]string  `yaml:"headers"`
+	CacheControl      string             `yaml:"cache_control"`
+	RedirectTemplate  string             `yaml:"redirect_template"`
+	EmptyRedirectBody bool               `yaml:"empty_redirect_body"`
+	ErrorPages        string             `yaml:"error_pages"`
+	Interstitial      interstitialConfig `yaml:"interstitial"`
+	Maintenance       maintenanceConfig  `yaml:"maintenance"`
+	GeoIP             geoipConfig        `yaml:"geoip"`
+	LuaScript         string             `yaml:"lua_script"`
+	WASMPlugin        string             `yaml:"wasm_plugin"`
+	Redis             redisConfig        `yaml:"redis"`
+	Files             filesConfig        `yaml:"files"`
+	Logging           loggingConfig      `yaml:"logging"`
+	Timeouts          timeoutsConfig     `yaml:"timeouts"`
+	Limits            limitsConfig       `yaml:"limits"`
+	StatsD            statsdConfig       `yaml:"statsd"`
+	OTLP              otlpConfig         `yaml:"otlp"`
+	// WatchConfig reloads the config when the config or rules file changes
+	WatchConfig bool `yaml:"watch_config"`
+	// PollInterval is the interval remote config and rules files are
+	// checked for changes, disabled if 0
+	PollInterval time.Duration `yaml:"poll_interval"`
+	// Git keeps a checkout of a repository with rule files up to date
+	Git gitConfig `yaml:"git"`
+	// Include lists glob patterns of rules files merged into the rules,
+	// relative paths are resolved against the directory of the config file
+	Include []string `yaml:"include"`
+	// RulesFile is loaded in addition to the inline rules
+	RulesFile string `yaml:"rules_file"`
+	Rules     []rule `yaml:"rules"`
+	// Store is an SQLite database or a postgres:// or mysql:// URL keeping
+	// rules added at runtime and hits, StoreClicks also keeps every request
+	Store       string `yaml:"store"`
+	StoreClicks bool   `yaml:"store_clicks"`
+
+	// file is the config file the settings were read from
+	file string
+	// includes are the resolved include patterns
+	includes []string
+	// args are the arguments left after the flags
+	args []string
+
+	fallbackPage     []byte
+	interstitial     *template.Template
+	redirectTemplate *template.Template
+	errorPages       map[int]*template.Template
+	staticFiles      []staticFile
+	maintenancePage  []byte
+	hooks            []redirectHook
+	geoip            *geoLocator
+	store            *ruleStore
+	certificates     map[string][]tls.Certificate
+	tlsParameters    tlsParameters
+	accessTemplate   accessTemplate
+	accessExcluded   []*net.IPNet
+	socketOptions    socketOptions
+	proxySources     []*net.IPNet
+	trustedProxies   []*net.IPNet
+	acme             *autocert.Manager
+	acmeDNS          *dnsIssuer
+	closers          []io.Closer
+	closeOnce        sync.Once
+}
+
+type listenConfig struct {
+	Address string `yaml:"address"`
+	// Admin is the address of the internal admin listener, disabled if empty
+	Admin string `yaml:"admin"`
+	// HTTPSRedirect is the address of a plain HTTP listener redirecting all
+	// requests to HTTPS when TLS is enabled
+	HTTPSRedirect string `yaml:"https_redirect"`
+	// H2C accepts HTTP/2 without TLS (prior knowledge) on the plain listener
+	H2C bool `yaml:"h2c"`
+	// HTTP3 serves HTTP/3 on the UDP port of the TLS listener, experimental
+	HTTP3 bool `yaml:"http3"`
+	// SocketMode and SocketOwner are the permissions of unix domain sockets
+	SocketMode  string `yaml:"socket_mode"`
+	SocketOwner string `yaml:"socket_owner"`
+	// TCPKeepAlive is the keep-alive period of TCP connections, 0 uses Go's
+	// default of 15s and a negative value disables keep-alives
+	TCPKeepAlive time.Duration `yaml:"tcp_keepalive"`
+	// ReusePort sets SO_REUSEPORT on TCP listeners
+	ReusePort bool `yaml:"reuse_port"`
+	// Backlog is the length of the queue of connections waiting to be
+	// accepted, the system default if 0
+	Backlog int `yaml:"backlog"`
+	// ProxyProtocol reads the PROXY protocol header of load balancers on the
+	// listener, the https redirect and the acme challenge listener.
+	// ProxyProtocolFrom limits the header to these networks.
+	ProxyProtocol     bool     `yaml:"proxy_protocol"`
+	ProxyProtocolFrom []string `yaml:"proxy_protocol_from"`
+}
+
+type interstitialConfig struct {
+	Template string `yaml:"template"`
+	Delay    int    `yaml:"delay"`
+}
+
+type maintenanceConfig struct {
+	Enabled    bool          `yaml:"enabled"`
+	Page       string        `yaml:"page"`
+	RetryAfter time.Duration `yaml:"retry_after"`
+}
+
+type geoipConfig struct {
+	Database  string `yaml:"database"`
+	CacheSize int    `yaml:"cache_size"`
+}
+
+type filesConfig struct {
+	RobotsTxt               string `yaml:"robots_txt"`
+	RobotsDisallowAll       bool   `yaml:"robots_disallow_all"`
+	Favicon                 string `yaml:"favicon"`
+	FaviconNoContent        bool   `yaml:"favicon_no_content"`
+	WellKnownDir            string `yaml:"well_known_dir"`
+	WellKnownExclude        bool   `yaml:"well_known_exclude"`
+	AppleAppSiteAssociation string `yaml:"apple_app_site_association"`
+	AssetLinks              string `yaml:"assetlinks"`
+}
+
+type loggingConfig struct {
+	Debug bool `yaml:"debug"`
+	// Level is the level of the application log, debug, info, warn or error
+	Level string `yaml:"level"`
+	// Format is the format of the application log, text or json
+	Format string `yaml:"format"`
+	// Levels overrides the level of components like store or tls
+	Levels map[string]string `yaml:"levels"`
+	// Output is stdout, stderr, syslog, a remote syslog server or a file the
+	// access and application log are written to, Rotation applies to files
+	Output   string       `yaml:"output"`
+	Rotation logRotation  `yaml:"rotation"`
+	Syslog   syslogConfig `yaml:"syslog"`
+	// ExcludePaths are path patterns like /healthz or /static/* and
+	// ExcludeSources networks of clients not written to the access log
+	ExcludePaths   []string `yaml:"exclude_paths"`
+	ExcludeSources []string `yaml:"exclude_sources"`
+	// AnonymizeIP truncates or hashes the client addresses of the access log
+	AnonymizeIP string `yaml:"anonymize_ip"`
+	// Sample writes 1 in Sample requests answered below 400 to the access
+	// log, all errors and blocked requests are written. All if 0 or 1.
+	Sample int `yaml:"sample"`
+	// AccessOutput is the destination of the access log if it differs from
+	// Output
+	AccessOutput string `yaml:"access_output"`
+	// AccessFormat is the format of the access log, combined or json
+	AccessFormat string `yaml:"access_format"`
+}
+
+type timeoutsConfig struct {
+	// Graceful is the time existing connections get to finish on shutdown
+	Graceful time.Duration `yaml:"graceful"`
+	// Read, ReadHeader, Write and Idle are the timeouts of the http.Server
+	// of all listeners, disabled if 0
+	Read       time.Duration `yaml:"read"`
+	ReadHeader time.Duration `yaml:"read_header"`
+	Write      time.Duration `yaml:"write"`
+	Idle       time.Duration `yaml:"idle"`
+}
+
+// apply sets the timeouts of the server
+func (t timeoutsConfig) apply(srv *http.Server) {
+	srv.ReadTimeout = t.Read
+	srv.ReadHeaderTimeout = t.ReadHeader
+	srv.WriteTimeout = t.Write
+	srv.IdleTimeout = t.Idle
+}
+
+func defaultConfig() *config {
+	return &config{
+		Listen:          listenConfig{Address: "0.0.0.0:8080"},
+		Redirect:        "https://google.com",
+		RequestIDHeader: defaultRequestIDHeader,
+		HealthPath:      defaultHealthPath,
+		LivePath:        defaultLivePath,
+		ReadyPath:       defaultReadyPath,
+		Status:          http.StatusMovedPermanently,
+		Fallback:        fallbackRedirect,
+		Headers:         make(map[string]string),
+		Interstitial:    interstitialConfig{Delay: 5},
+		Maintenance:     maintenanceConfig{RetryAfter: time.Hour},
+		GeoIP:           geoipConfig{CacheSize: 10000},
+		Redis:           redisConfig{Prefix: "redirector:", CacheTTL: 10 * time.Second, CacheSize: 10000},
+		Logging: loggingConfig{
+			Level:        "info",
+			Format:       logFormatText,
+			Levels:       make(map[string]string),
+			Output:       logOutputStdout,
+			Rotation:     logRotation{MaxSize: defaultLogMaxSize},
+			Syslog:       syslogConfig{Facility: "daemon", Tag: "redirector"},
+			AccessFormat: accessFormatCombined,
+		},
+		Timeouts: timeoutsConfig{
+			Graceful:   defaultGracefulTimeout,
+			Read:       defaultReadTimeout,
+			ReadHeader: defaultReadHeaderTimeout,
+			Write:      defaultWriteTimeout,
+			Idle:       defaultIdleTimeout,
+		},
+		Limits:       limitsConfig{MaxHeaderBytes: defaultMaxHeaderBytes, MaxBodyBytes: defaultMaxBodyBytes},
+		StatsD:       statsdConfig{Prefix: "redirector."},
+		OTLP:         otlpConfig{ServiceName: "redirector", TraceSampleRatio: 1, MetricsInterval: time.Minute},
+		PollInterval: time.Minute,
+		Git:          gitConfig{Interval: time.Minute},
+		TLS:          tlsConfig{ACME: acmeConfig{Cache: "acme"}},
+	}
+}
+
+// flagSet returns the command line flags writing into the config
+func (cfg *config) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	fs.StringVar(&cfg.file, "config", cfg.file, "YAML, JSON or TOML config file or http(s) URL, flags override its values")
+	fs.StringVar(&cfg.Listen.Address, "host", cfg.Listen.Address, "IP and Port to bind to, unix:/path/to/socket for a unix domain socket or systemd:name for a socket passed by systemd")
+	fs.StringVar(&cfg.Listen.SocketMode, "socket-mode", cfg.Listen.SocketMode, "octal permissions of unix domain sockets, e.g. 0660")
+	fs.StringVar(&cfg.Listen.SocketOwner, "socket-owner", cfg.Listen.SocketOwner, "owner of unix domain sockets as user, user:group or :group")
+	fs.BoolVar(&cfg.Listen.ProxyProtocol, "proxy-protocol", cfg.Listen.ProxyProtocol, "require the PROXY protocol header of a load balancer like haproxy or AWS NLB on -host, -https-redirect-host and -acme-http-host")
+	fs.DurationVar(&cfg.Listen.TCPKeepAlive, "tcp-keepalive", cfg.Listen.TCPKeepAlive, "keep-alive period of TCP connections, Go's default of 15s if 0, disabled if negative")
+	fs.BoolVar(&cfg.Listen.ReusePort, "reuse-port", cfg.Listen.ReusePort, "set SO_REUSEPORT on TCP listeners so several processes can listen on the same port")
+	fs.IntVar(&cfg.Listen.Backlog, "backlog", cfg.Listen.Backlog, "length of the queue of connections waiting to be accepted, capped by net.core.somaxconn. The system default if 0")
+	fs.Var((*listFlag)(&cfg.Listen.ProxyProtocolFrom), "proxy-protocol-from", "comma separated list of networks of the load balancers, connections from other addresses are served without PROXY header. Required from all if empty")
+	fs.Var((*listFlag)(&cfg.TrustedProxies), "trusted-proxies", "comma separated list of networks of proxies like Cloudflare or a load balancer, the client address of their Forwarded, X-Forwarded-For or X-Real-IP header is used")
+	fs.StringVar(&cfg.RequestIDHeader, "request-id-header", cfg.RequestIDHeader, "header the id of a request is taken from or generated in, sent back in the response and written to the logs. Disabled if empty")
+	fs.StringVar(&cfg.HealthPath, "health-path", cfg.HealthPath, "path answered with 200 and a JSON status on all listeners for load balancer health checks instead of being redirected, disabled if empty")
+	fs.StringVar(&cfg.LivePath, "live-path", cfg.LivePath, "path answered with 200 as long as the process runs for liveness probes, disabled if empty")
+	fs.StringVar(&cfg.ReadyPath, "ready-path", cfg.ReadyPath, "path answered with 200 once all listeners are started and the store, redis and certificates are ok, with 503 otherwise. Disabled if empty")
+	fs.StringVar(&cfg.Listen.Admin, "admin-host", cfg.Listen.Admin, "IP and Port of the internal admin listener, disabled if empty")
+	fs.BoolVar(&cfg.PProf, "pprof", cfg.PProf, "serve CPU, heap and other profiles of net/http/pprof below /debug/pprof/ on the admin listener")
+	fs.StringVar(&cfg.Listen.HTTPSRedirect, "https-redirect-host", cfg.Listen.HTTPSRedirect, "IP and Port of a HTTP listener redirecting every request to HTTPS on -host, e.g. 0.0.0.0:80")
+	fs.BoolVar(&cfg.Listen.H2C, "h2c", cfg.Listen.H2C, "accept HTTP/2 without TLS on -host, e.g. from a CDN speaking h2c to origins")
+	fs.BoolVar(&cfg.Listen.HTTP3, "http3", cfg.Listen.HTTP3, "experimental: serve HTTP/3 on the UDP port of -host and advertise it with Alt-Svc, requires TLS")
+	fs.StringVar(&cfg.TLS.Cert, "tls-cert", cfg.TLS.Cert, "PEM certificate (chain) to serve HTTPS on -host")
+	fs.StringVar(&cfg.TLS.Key, "tls-key", cfg.TLS.Key, "PEM private key of -tls-cert")
+	fs.Var((*certificateFlag)(&cfg.TLS.Certificates), "tls-certificate", "further certificate selected by the server name of the client in the form cert.pem,key.pem, can be repeated")
+	fs.StringVar(&cfg.TLS.MinVersion, "tls-min-version", cfg.TLS.MinVersion, "minimum TLS version of clients: 1.0, 1.1, 1.2 or 1.3")
+	fs.Var((*listFlag)(&cfg.TLS.Ciphers), "tls-ciphers", "comma separated list of allowed TLS 1.2 cipher suites, e.g. TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256. Go's defaults if empty")
+	fs.Var((*listFlag)(&cfg.TLS.Curves), "tls-curves", "comma separated list of key exchanges in order of preference: X25519, X25519MLKEM768, P256, P384, P521. Go's defaults if empty")
+	fs.StringVar(&cfg.TLS.ClientCA, "tls-client-ca", cfg.TLS.ClientCA, "PEM file with the CAs clients need a certificate of to connect, client certificates are not requested if empty")
+	fs.BoolVar(&cfg.TLS.ACME.Enabled, "acme", cfg.TLS.ACME.Enabled, "obtain certificates for -acme-hosts from Let's Encrypt and serve HTTPS on -host")
+	fs.Var((*listFlag)(&cfg.TLS.ACME.Hosts), "acme-hosts", "comma separated list of hosts certificates are requested for")
+	fs.StringVar(&cfg.TLS.ACME.Cache, "acme-cache", cfg.TLS.ACME.Cache, "directory keeping the acme account and certificates")
+	fs.StringVar(&cfg.TLS.ACME.Email, "acme-email", cfg.TLS.ACME.Email, "contact email of the acme account")
+	fs.StringVar(&cfg.TLS.ACME.HTTP, "acme-http-host", cfg.TLS.ACME.HTTP, "IP and Port of a HTTP listener answering HTTP-01 challenges, e.g. 0.0.0.0:80. Only TLS-ALPN-01 is used if empty")
+	fs.StringVar(&cfg.TLS.ACME.DNSProvider, "acme-dns", cfg.TLS.ACME.DNSProvider, "solve DNS-01 challenges with the provider cloudflare, route53 or rfc2136, required for wildcard hosts")
+	fs.StringVar(&cfg.TLS.ACME.DirectoryURL, "acme-directory", cfg.TLS.ACME.DirectoryURL, "directory URL of the acme CA, Let's Encrypt if empty")
+	fs.StringVar(&cfg.Redirect, "redirect", cfg.Redirect, "redirect target")
+	fs.BoolVar(&cfg.WatchConfig, "watch-config", cfg.WatchConfig, "reload the config automatically when the config or rules file changes")
+	fs.DurationVar(&cfg.PollInterval, "poll-interval", cfg.PollInterval, "interval remote config and rules files given as http(s) URL are checked for changes, disabled if 0")
+	fs.StringVar(&cfg.Git.Repository, "git-repo", cfg.Git.Repository, "git repository with rule files, checked out to -git-dir and updated every -git-interval")
+	fs.StringVar(&cfg.Git.Branch, "git-branch", cfg.Git.Branch, "branch of the git repository, the default branch if empty")
+	fs.StringVar(&cfg.Git.Directory, "git-dir", cfg.Git.Directory, "directory the git repository is checked out to")
+	fs.DurationVar(&cfg.Git.Interval, "git-interval", cfg.Git.Interval, "interval the git repository is updated, disabled if 0")
+	fs.StringVar(&cfg.Store, "store", cfg.Store, "SQLite database or postgres:// or mysql:// URL keeping rules added through the admin api and hit counters")
+	fs.BoolVar(&cfg.StoreClicks, "store-clicks", cfg.StoreClicks, "keep time, referer and user agent of every request matching a rule in the store")
+	fs.StringVar(&cfg.RulesFile, "rules", cfg.RulesFile, "JSON, YAML or TOML file or http(s) URL containing host and path based redirect rules")
+	fs.IntVar(&cfg.Status, "status", cfg.Status, "HTTP status code used for redirects (301, 302, 307 or 308)")
+	fs.BoolVar(&cfg.PreservePath, "preserve-path", cfg.PreservePath, "append the request path to the redirect target")
+	fs.BoolVar(&cfg.PreserveQuery, "preserve-query", cfg.PreserveQuery, "append the request query string to the redirect target")
+	fs.StringVar(&cfg.Fallback, "fallback", cfg.Fallback, "what to do with requests not matching any rule: redirect, 404, 204 or page")
+	fs.StringVar(&cfg.FallbackPage, "fallback-page", cfg.FallbackPage, "HTML file served to unmatched requests when using -fallback page")
+	fs.Var((*listFlag)(&cfg.Methods), "methods", "comma separated list of allowed HTTP methods, e.g. GET,HEAD. All methods are allowed if empty")
+	fs.BoolVar(&cfg.IgnoreCase, "ignore-case", cfg.IgnoreCase, "match rule paths case insensitive")
+	fs.StringVar(&cfg.TrailingSlash, "trailing-slash", cfg.TrailingSlash, "treat /foo and /foo/ as equal when matching rules: ignore, strip (redirect /foo/ to /foo first) or add (redirect /foo to /foo/ first)")
+	fs.StringVar(&cfg.CanonicalHost, "canonical-host", cfg.CanonicalHost, "enforce a canonical host by redirecting to it first: strip-www or add-www")
+	fs.StringVar(&cfg.Interstitial.Template, "interstitial-template", cfg.Interstitial.Template, "HTML template for interstitial pages, uses a built in page if empty")
+	fs.IntVar(&cfg.Interstitial.Delay, "interstitial-delay", cfg.Interstitial.Delay, "seconds an interstitial page waits before redirecting")
+	fs.StringVar(&cfg.GeoIP.Database, "geoip-db", cfg.GeoIP.Database, "MaxMind GeoLite2/GeoIP2 country database used for country targets")
+	fs.IntVar(&cfg.GeoIP.CacheSize, "geoip-cache-size", cfg.GeoIP.CacheSize, "number of geoip lookups to cache")
+	fs.StringVar(&cfg.LuaScript, "lua-script", cfg.LuaScript, "Lua script with a redirect(request) function deciding the target before the rules are evaluated")
+	fs.StringVar(&cfg.WASMPlugin, "wasm-plugin", cfg.WASMPlugin, "WASM module deciding the target before the rules are evaluated")
+	fs.StringVar(&cfg.Redis.URL, "redis-url", cfg.Redis.URL, "redis server looked up for every request before the rules are evaluated, e.g. redis://127.0.0.1:6379/0")
+	fs.StringVar(&cfg.Redis.Prefix, "redis-prefix", cfg.Redis.Prefix, "prefix of the redis keys")
+	fs.DurationVar(&cfg.Redis.CacheTTL, "redis-cache-ttl", cfg.Redis.CacheTTL, "time redis lookups are cached, disabled if 0")
+	fs.IntVar(&cfg.Redis.CacheSize, "redis-cache-size", cfg.Redis.CacheSize, "number of redis lookups to cache")
+	fs.BoolVar(&cfg.Maintenance.Enabled, "maintenance", cfg.Maintenance.Enabled, "start in maintenance mode, answering every request with 503. Toggle at runtime with SIGUSR1 or the admin listener")
+	fs.StringVar(&cfg.Maintenance.Page, "maintenance-page", cfg.Maintenance.Page, "HTML file served in maintenance mode, uses a built in page if empty")
+	fs.DurationVar(&cfg.Maintenance.RetryAfter, "maintenance-retry-after", cfg.Maintenance.RetryAfter, "Retry-After sent in maintenance mode, disabled if 0")
+	fs.Var(headerFlag(cfg.Headers), "header", "header added to every response in the form \"Name: value\", can be repeated")
+	fs.StringVar(&cfg.CacheControl, "cache-control", cfg.CacheControl, "Cache-Control header for redirects, e.g. no-store or max-age=86400. An Expires header is derived from it")
+	fs.StringVar(&cfg.RedirectTemplate, "redirect-template", cfg.RedirectTemplate, "HTML template used as body of redirects instead of the default body")
+	fs.BoolVar(&cfg.EmptyRedirectBody, "empty-redirect-body", cfg.EmptyRedirectBody, "send redirects without a body")
+	fs.StringVar(&cfg.ErrorPages, "error-pages", cfg.ErrorPages, "directory with HTML templates for error responses named after the status code, e.g. 404.html")
+	fs.StringVar(&cfg.Files.RobotsTxt, "robots-txt", cfg.Files.RobotsTxt, "serve this file as /robots.txt instead of redirecting it")
+	fs.BoolVar(&cfg.Files.RobotsDisallowAll, "robots-disallow-all", cfg.Files.RobotsDisallowAll, "serve a /robots.txt disallowing all crawlers")
+	fs.StringVar(&cfg.Files.WellKnownDir, "well-known-dir", cfg.Files.WellKnownDir, "directory with files served below /.well-known/, e.g. security.txt or acme-challenge")
+	fs.BoolVar(&cfg.Files.WellKnownExclude, "well-known-exclude", cfg.Files.WellKnownExclude, "answer requests below /.well-known/ not found in -well-known-dir with 404 instead of redirecting them")
+	fs.StringVar(&cfg.Files.Favicon, "favicon", cfg.Files.Favicon, "serve this file as /favicon.ico instead of redirecting it")
+	fs.BoolVar(&cfg.Files.FaviconNoContent, "favicon-no-content", cfg.Files.FaviconNoContent, "answer /favicon.ico with 204 No Content instead of redirecting it")
+	fs.StringVar(&cfg.Files.AppleAppSiteAssociation, "apple-app-site-association", cfg.Files.AppleAppSiteAssociation, "JSON file served as /.well-known/apple-app-site-association for iOS universal links")
+	fs.StringVar(&cfg.Files.AssetLinks, "assetlinks", cfg.Files.AssetLinks, "JSON file served as /.well-known/assetlinks.json for Android app links")
+	fs.BoolVar(&cfg.Logging.Debug, "debug", cfg.Logging.Debug, "Enable DEBUG mode")
+	fs.StringVar(&cfg.Logging.Level, "log-level", cfg.Logging.Level, "level of the application log: debug, info, warn or error")
+	fs.StringVar(&cfg.Logging.Format, "log-format", cfg.Logging.Format, "format of the application log: text or json")
+	fs.Var(levelsFlag(cfg.Logging.Levels), "log-levels", "levels of single components overriding -log-level, e.g. store=debug,tls=warn")
+	fs.StringVar(&cfg.Logging.Output, "log-output", cfg.Logging.Output, "stdout, stderr, syslog, syslog+udp://host:port, syslog+tcp://host:port or a file the access and application log are written to")
+	fs.IntVar(&cfg.Logging.Rotation.MaxSize, "log-max-size", cfg.Logging.Rotation.MaxSize, "size in megabytes a log file is rotated at")
+	fs.DurationVar(&cfg.Logging.Rotation.Interval, "log-rotate-interval", cfg.Logging.Rotation.Interval, "rotate the log file after this time regardless of its size, e.g. 24h, disabled if 0")
+	fs.DurationVar(&cfg.Logging.Rotation.MaxAge, "log-max-age", cfg.Logging.Rotation.MaxAge, "remove rotated log files older than this, rounded up to days, kept if 0")
+	fs.IntVar(&cfg.Logging.Rotation.MaxBackups, "log-max-backups", cfg.Logging.Rotation.MaxBackups, "number of rotated log files kept, all if 0")
+	fs.BoolVar(&cfg.Logging.Rotation.Compress, "log-compress", cfg.Logging.Rotation.Compress, "gzip rotated log files")
+	fs.StringVar(&cfg.Logging.Syslog.Facility, "syslog-facility", cfg.Logging.Syslog.Facility, "facility of syslog messages, e.g. daemon or local0")
+	fs.StringVar(&cfg.Logging.Syslog.Tag, "syslog-tag", cfg.Logging.Syslog.Tag, "application name of syslog messages")
+	fs.StringVar(&cfg.Logging.AccessOutput, "access-log-output", cfg.Logging.AccessOutput, "destination of the access log instead of -log-output, same values as -log-output")
+	fs.Var((*listFlag)(&cfg.Logging.ExcludePaths), "access-log-exclude-paths", "comma separated list of path patterns like /healthz or /static/* not written to the access log")
+	fs.Var((*listFlag)(&cfg.Logging.ExcludeSources), "access-log-exclude-sources", "comma separated list of client networks not written to the access log, e.g. internal monitors")
+	fs.StringVar(&cfg.Logging.AnonymizeIP, "access-log-anonymize-ip", cfg.Logging.AnonymizeIP, "anonymize the client addresses of the access log: truncate (IPv4 to /24, IPv6 to /48) or hash (with a daily salt)")
+	fs.IntVar(&cfg.Logging.Sample, "access-log-sample", cfg.Logging.Sample, "write 1 in N requests answered below 400 to the access log, errors and blocked requests are always written. All if 0 or 1")
+	fs.StringVar(&cfg.Logging.AccessFormat, "access-log-format", cfg.Logging.AccessFormat, "format of the access log: combined (Apache combined log format), json (one object per request) or a template like \"$remote_addr $host $request $status $location $duration\"")
+	fs.DurationVar(&cfg.Timeouts.Graceful, "graceful-timeout", cfg.Timeouts.Graceful, "the duration for which the server gracefully wait for existing connections to finish - e.g. 15s or 1m")
+	fs.DurationVar(&cfg.Timeouts.Read, "read-timeout", cfg.Timeouts.Read, "maximum duration for reading a request including the body, disabled if 0")
+	fs.DurationVar(&cfg.Timeouts.ReadHeader, "read-header-timeout", cfg.Timeouts.ReadHeader, "maximum duration for reading the request headers, disabled if 0")
+	fs.DurationVar(&cfg.Timeouts.Write, "write-timeout", cfg.Timeouts.Write, "maximum duration from the end of the request headers until the response is written, disabled if 0")
+	fs.IntVar(&cfg.Limits.MaxHeaderBytes, "max-header-bytes", cfg.Limits.MaxHeaderBytes, "maximum size of the request line and headers in bytes")
+	fs.IntVar(&cfg.Limits.MaxConnections, "max-connections", cfg.Limits.MaxConnections, "maximum number of concurrent connections of all listeners except the admin listener, further connections wait. Unlimited if 0")
+	fs.IntVar(&cfg.Limits.MaxConnectionsPerIP, "max-connections-per-ip", cfg.Limits.MaxConnectionsPerIP, "maximum number of concurrent connections of a client address, requests on further connections are answered with 429. Unlimited if 0")
+	fs.Int64Var(&cfg.Limits.MaxBodyBytes, "max-body-bytes", cfg.Limits.MaxBodyBytes, "maximum size of request bodies in bytes, larger requests are answered with 413. Unlimited if 0")
+	fs.DurationVar(&cfg.Timeouts.Idle, "idle-timeout", cfg.Timeouts.Idle, "maximum duration an idle keep-alive connection is kept open, disabled if 0")
+	fs.StringVar(&cfg.StatsD.Address, "statsd", cfg.StatsD.Address, "address of a StatsD or DogStatsD agent request counts and durations are sent to, e.g. 127.0.0.1:8125, disabled if empty")
+	fs.StringVar(&cfg.StatsD.Prefix, "statsd-prefix", cfg.StatsD.Prefix, "prefix of the StatsD metric names")
+	fs.Var((*listFlag)(&cfg.StatsD.Tags), "statsd-tags", "comma separated list of tags sent with every StatsD metric, e.g. env:prod,region:eu")
+	fs.StringVar(&cfg.OTLP.Endpoint, "otlp-endpoint", cfg.OTLP.Endpoint, "base URL of the OTLP/HTTP receiver of an OpenTelemetry collector spans of the requests are exported to, e.g. http://127.0.0.1:4318. Disabled if empty")
+	fs.StringVar(&cfg.OTLP.ServiceName, "otlp-service-name", cfg.OTLP.ServiceName, "service name of the exported telemetry")
+	fs.Float64Var(&cfg.OTLP.TraceSampleRatio, "trace-sample-ratio", cfg.OTLP.TraceSampleRatio, "share of requests traced between 0 and 1, requests of traces sampled by the caller are always traced")
+	fs.BoolVar(&cfg.OTLP.Metrics, "otlp-metrics", cfg.OTLP.Metrics, "push the request metrics to -otlp-endpoint")
+	fs.DurationVar(&cfg.OTLP.MetricsInterval, "otlp-metrics-interval", cfg.OTLP.MetricsInterval, "interval the metrics are pushed to -otlp-endpoint")
+	fs.StringVar(&cfg.OTLP.AnonymizeIP, "otlp-anonymize-ip", cfg.OTLP.AnonymizeIP, "anonymize the client addresses of spans: truncate (IPv4 to /24, IPv6 to /48) or hash (with a daily salt)")
+	return fs
+}
+
+// parseConfig reads the config file given with -config and applies the
+// environment and the command line flags on top of it. extra adds flags of
+// subcommands.
+func parseConfig(args []string, extra ...func(*flag.FlagSet)) (*config, error) {
+	cfg := defaultConfig()
+	if err := cfg.parseFlags(args, extra...); err != nil {
+		return nil, err
+	}
+	if cfg.file == "" {
+		return cfg, nil
+	}
+	file := cfg.file
+	cfg = defaultConfig()
+	if err := cfg.loadFile(file); err != nil {
+		return nil, err
+	}
+	// parse again so the environment and flags take precedence over the file
+	if err := cfg.parseFlags(args, extra...); err != nil {
+		return nil, err
+	}
+	cfg.file = file
+	return cfg, nil
+}
+
+// parseFlags applies the environment variables and then the command line
+// flags to the config. Every flag can be set as REDIRECTOR_<NAME>, e.g.
+// REDIRECTOR_PRESERVE_PATH=true for -preserve-path.
+func (cfg *config) parseFlags(args []string, extra ...func(*flag.FlagSet)) error {
+	fs := cfg.flagSet()
+	for _, add := range extra {
+		add(fs)
+	}
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		name := envName(f.Name)
+		if value, ok := os.LookupEnv(name); ok && err == nil {
+			if setErr := fs.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid value %q for %s: %w", value, name, setErr)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	cfg.args = fs.Args()
+	return nil
+}
+
+// envName returns the environment variable of the flag
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// loadFile reads the settings from a YAML, JSON or TOML file, environment
+// variables are only expanded in local files
+func (cfg *config) loadFile(filename string) error {
+	content, err := decodeFile(filename, cfg, !isRemote(filename))
+	if err != nil {
+		return fmt.Errorf("could not parse config file %s: %w", filename, err)
+	}
+	setRuleSources(cfg.Rules, filename, "rules", content)
+	return nil
+}
+
+// decodeFile decodes the file into v, unknown fields are rejected. With
+// expand the environment variables referenced as ${env:VAR} in its values
+// are expanded. JSON is a subset of YAML so both are handled by the YAML
+// decoder, TOML files are detected by their extension and converted to
+// YAML first to share the field names and validation. Remote files are
+// fetched by their URL. The content is returned.
+func decodeFile(filename string, v any, expand bool) ([]byte, error) {
+	content, err := readSource(filename)
+	if err != nil {
+		return nil, err
+	}
+	data := content
+	if isTOML(filename) {
+		var doc map[string]any
+		if err := toml.Unmarshal(content, &doc); err != nil {
+			return nil, err
+		}
+		if data, err = yaml.Marshal(doc); err != nil {
+			return nil, err
+		}
+	}
+	if expand {
+		if data, err = expandEnvValues(data); err != nil {
+			return nil, err
+		}
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(v); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return content, nil
+}
+
+// readSource returns the content of a local file or a remote URL
+func readSource(name string) ([]byte, error) {
+	if isRemote(name) {
+		content, _, err := fetchRemote(name)
+		return content, err
+	}
+	return os.ReadFile(name)
+}
+
+var envVarRegex = regexp.MustCompile(`\$?\$\{env:([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// expandEnvValues expands the environment variables in the values of the
+// YAML document. Only the decoded values are replaced, so a variable can
+// not change the structure of the document. Unquoted values are typed
+// again after the expansion, e.g. status: ${env:STATUS} becomes a number.
+func expandEnvValues(data []byte) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	changed, err := expandEnvNode(&doc)
+	if err != nil || !changed {
+		return data, err
+	}
+	return yaml.Marshal(&doc)
+}
+
+func expandEnvNode(n *yaml.Node) (bool, error) {
+	switch n.Kind {
+	case yaml.ScalarNode:
+		value, err := expandEnv(n.Value)
+		if err != nil || value == n.Value {
+			return false, err
+		}
+		n.Value = value
+		if n.Style == 0 {
+			n.Tag = ""
+		}
+		return true, nil
+	case yaml.MappingNode:
+		// only the values of mappings, not their keys
+		changed := false
+		for i := 1; i < len(n.Content); i += 2 {
+			c, err := expandEnvNode(n.Content[i])
+			if err != nil {
+				return false, err
+			}
+			changed = changed || c
+		}
+		return changed, nil
+	}
+	changed := false
+	for _, c := range n.Content {
+		ok, err := expandEnvNode(c)
+		if err != nil {
+			return false, err
+		}
+		changed = changed || ok
+	}
+	return changed, nil
+}
+
+// expandEnv replaces ${env:VAR} and ${env:VAR:-default} by the value of the
+// environment variable, $${env:VAR} escapes the reference. The prefix keeps
+// the references apart from named regex groups like ${name} in targets.
+func expandEnv(value string) (string, error) {
+	var err error
+	expanded := envVarRegex.ReplaceAllStringFunc(value, func(m string) string {
+		if strings.HasPrefix(m, "$$") {
+			return m[1:]
+		}
+		sub := envVarRegex.FindStringSubmatch(m)
+		if v, ok := os.LookupEnv(sub[1]); ok {
+			return v
+		}
+		if sub[2] != "" {
+			return sub[3]
+		}
+		err = fmt.Errorf("environment variable %s is not set", sub[1])
+		return m
+	})
+	return expanded, err
+}
+
+// setRuleSources records the file and line each rule was read from for
+// error messages. key is the name of the rule list in the file or empty if
+// the list is the top level element. TOML files only record the file.
+func setRuleSources(rules []rule, filename, key string, content []byte) {
+	var lines []int
+	if !isTOML(filename) {
+		var doc yaml.Node
+		if yaml.Unmarshal(content, &doc) == nil && len(doc.Content) > 0 {
+			list := doc.Content[0]
+			if key != "" {
+				list = mappingValue(list, key)
+			}
+			if list != nil && list.Kind == yaml.SequenceNode {
+				for _, item := range list.Content {
+					lines = append(lines, item.Line)
+				}
+			}
+		}
+	}
+	for i := range rules {
+		rules[i].source = filename
+		if i < len(lines) {
+			rules[i].source = fmt.Sprintf("%s:%d", filename, lines[i])
+		}
+	}
+}
+
+// mappingValue returns the value of the key in a YAML mapping or nil
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func isTOML(filename string) bool {
+	if isRemote(filename) {
+		if u, err := url.Parse(filename); err == nil {
+			filename = u.Path
+		}
+	}
+	return strings.EqualFold(filepath.Ext(filename), ".toml")
+}
+
+// prepare validates the config, opens the databases and connections it
+// references and prepares all rules
+func (cfg *config) prepare() error {
+	if err := cfg.check(); err != nil {
+		return err
+	}
+	if err := cfg.open(); err != nil {
+		return err
+	}
+	return cfg.prepareRules()
+}
+
+// check validates the config and loads all files it references without
+// opening databases or connections, the rules are prepared separately so
+// those of the store can be added first
+func (cfg *config) check() error {
+	if err := validateTarget(cfg.Redirect); err != nil {
+		return err
+	}
+	if !validRedirectStatus(cfg.Status) {
+		return fmt.Errorf("invalid redirect status code %d", cfg.Status)
+	}
+	opts, err := parseSocketOptions(cfg.Listen)
+	if err != nil {
+		return err
+	}
+	cfg.socketOptions = opts
+	if cfg.proxySources, err = parseNetworks(cfg.Listen.ProxyProtocolFrom); err != nil {
+		return fmt.Errorf("invalid proxy protocol source: %w", err)
+	}
+	if cfg.trustedProxies, err = parseNetworks(cfg.TrustedProxies); err != nil {
+		return fmt.Errorf("invalid trusted proxy: %w", err)
+	}
+	for _, p := range []string{cfg.HealthPath, cfg.LivePath, cfg.ReadyPath} {
+		if p != "" && !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("health check path %q must start with /", p)
+		}
+	}
+	if err := cfg.OTLP.validate(); err != nil {
+		return err
+	}
+	if err := cfg.loadTLS(); err != nil {
+		return err
+	}
+	if err := cfg.prepareListeners(); err != nil {
+		return err
+	}
+	certs, err := loadCertificateSets(cfg.certificateFiles())
+	if err != nil {
+		return err
+	}
+	cfg.certificates = certs
+
+	switch cfg.TrailingSlash {
+	case trailingSlashStrict, trailingSlashIgnore, trailingSlashStrip, trailingSlashAdd:
+	default:
+		return fmt.Errorf("invalid trailing slash mode %q", cfg.TrailingSlash)
+	}
+
+	switch cfg.Logging.AccessFormat {
+	case accessFormatCombined, accessFormatJSON:
+	default:
+		if !strings.Contains(cfg.Logging.AccessFormat, "$") {
+			return fmt.Errorf("invalid access log format %q", cfg.Logging.AccessFormat)
+		}
+		if cfg.accessTemplate, err = parseAccessTemplate(cfg.Logging.AccessFormat); err != nil {
+			return err
+		}
+	}
+	if err := cfg.Logging.validate(); err != nil {
+		return err
+	}
+	if cfg.accessExcluded, err = parseNetworks(cfg.Logging.ExcludeSources); err != nil {
+		return err
+	}
+
+	switch cfg.CanonicalHost {
+	case canonicalHostNone, canonicalHostStripWWW, canonicalHostAddWWW:
+	default:
+		return fmt.Errorf("invalid canonical host mode %q", cfg.CanonicalHost)
+	}
+
+	var methods []string
+	for _, m := range cfg.Methods {
+		if m = strings.ToUpper(strings.TrimSpace(m)); m != "" {
+			methods = append(methods, m)
+		}
+	}
+	cfg.Methods = methods
+
+	tmpl, err := loadInterstitialTemplate(cfg.Interstitial.Template)
+	if err != nil {
+		return err
+	}
+	cfg.interstitial = tmpl
+	if err := cfg.loadStaticFiles(); err != nil {
+		return err
+	}
+	if cfg.ErrorPages != "" {
+		pages, err := loadErrorPages(cfg.ErrorPages)
+		if err != nil {
+			return err
+		}
+		cfg.errorPages = pages
+	}
+	if cfg.RedirectTemplate != "" {
+		tmpl, err := loadRedirectTemplate(cfg.RedirectTemplate)
+		if err != nil {
+			return err
+		}
+		cfg.redirectTemplate = tmpl
+	}
+	if cfg.LuaScript != "" {
+		hook, err := loadLuaHook(cfg.LuaScript)
+		if err != nil {
+			return err
+		}
+		cfg.hooks = append(cfg.hooks, hook)
+	}
+	if cfg.WASMPlugin != "" {
+		plugin, err := loadWASMPlugin(cfg.WASMPlugin)
+		if err != nil {
+			return err
+		}
+		cfg.hooks = append(cfg.hooks, plugin)
+		cfg.closers = append(cfg.closers, plugin)
+	}
+	if err := cfg.Redis.validate(); err != nil {
+		return err
+	}
+	if cfg.Git.Repository != "" && cfg.Git.Directory == "" {
+		return fmt.Errorf("git repository requires a checkout directory")
+	}
+	cfg.maintenancePage = []byte(defaultMaintenancePage)
+	if cfg.Maintenance.Page != "" {
+		page, err := os.ReadFile(cfg.Maintenance.Page)
+		if err != nil {
+			return fmt.Errorf("could not read maintenance page: %w", err)
+		}
+		cfg.maintenancePage = page
+	}
+	switch cfg.Fallback {
+	case fallbackRedirect, fallbackNotFound, fallbackNoContent:
+	case fallbackPage:
+		if cfg.FallbackPage == "" {
+			return fmt.Errorf("fallback page requires a fallback page file")
+		}
+		page, err := os.ReadFile(cfg.FallbackPage)
+		if err != nil {
+			return fmt.Errorf("could not read fallback page: %w", err)
+		}
+		cfg.fallbackPage = page
+	default:
+		return fmt.Errorf("invalid fallback %q", cfg.Fallback)
+	}
+	if err := cfg.loadIncludes(); err != nil {
+		return err
+	}
+	if cfg.RulesFile != "" {
+		rules, err := loadRules(cfg.RulesFile, cfg.expandEnvIn(cfg.RulesFile))
+		if err != nil {
+			return err
+		}
+		cfg.Rules = append(cfg.Rules, rules...)
+		log.Infof("Loaded %d rules from %s", len(rules), cfg.RulesFile)
+	}
+	return nil
+}
+
+// open opens the GeoIP database, the connection to Redis and the store and
+// adds the rules of the store. The resources are released by close.
+func (cfg *config) open() error {
+	if cfg.GeoIP.Database != "" {
+		g, err := openGeoIP(cfg.GeoIP.Database, cfg.GeoIP.CacheSize)
+		if err != nil {
+			return err
+		}
+		cfg.geoip = g
+		cfg.closers = append(cfg.closers, g)
+	}
+
+	if cfg.Redis.URL != "" {
+		store, err := openRedisStore(cfg.Redis)
+		if err != nil {
+			return err
+		}
+		cfg.hooks = append(cfg.hooks, store)
+		cfg.closers = append(cfg.closers, store)
+	}
+	if cfg.Store != "" {
+		store, err := openRuleStore(cfg.Store, cfg.StoreClicks)
+		if err != nil {
+			return err
+		}
+		cfg.store = store
+		cfg.closers = append(cfg.closers, store)
+		rules, err := store.rules()
+		if err != nil {
+			return err
+		}
+		cfg.Rules = append(cfg.Rules, rules...)
+		log.Infof("Loaded %d rules from %s", len(rules), store.name)
+	}
+	return nil
+}
+
+// loadIncludes appends the rules of all files matching the include patterns
+// in alphabetical order
+func (cfg *config) loadIncludes() error {
+	for _, pattern := range cfg.Include {
+		pattern, err := resolveInclude(cfg.file, pattern)
+		if err != nil {
+			return err
+		}
+		cfg.includes = append(cfg.includes, pattern)
+		files := []string{pattern}
+		if !isURL(pattern) {
+			if files, err = filepath.Glob(pattern); err != nil {
+				return fmt.Errorf("invalid include %q: %w", pattern, err)
+			}
+		}
+		if len(files) == 0 {
+			log.Warnf("include %s does not match any file", pattern)
+		}
+		for _, f := range files {
+			rules, err := loadRules(f, cfg.expandEnvIn(f))
+			if err != nil {
+				return err
+			}
+			cfg.Rules = append(cfg.Rules, rules...)
+			log.Infof("Loaded %d rules from %s", len(rules), f)
+		}
+	}
+	return nil
+}
+
+// expandEnvIn reports if environment variables are expanded in a rules
+// file. Only local files are expanded, not those fetched from a URL or
+// checked out from git, which others than the operator can write.
+func (cfg *config) expandEnvIn(filename string) bool {
+	if isRemote(filename) {
+		return false
+	}
+	if cfg.Git.Directory == "" {
+		return true
+	}
+	dir, err := filepath.Abs(cfg.Git.Directory)
+	if err != nil {
+		return false
+	}
+	file, err := filepath.Abs(filename)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(dir, file)
+	return err == nil && (rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
+
+// resolveInclude resolves a relative include against the config file, which
+// can be a local file or a URL. Remote includes are single URLs or key
+// value stores, not globs.
+func resolveInclude(configFile, include string) (string, error) {
+	if isURL(include) || filepath.IsAbs(include) || configFile == "" {
+		return include, nil
+	}
+	if !isRemote(configFile) {
+		return filepath.Join(filepath.Dir(configFile), include), nil
+	}
+	base, err := url.Parse(configFile)
+	if err != nil {
+		return "", err
+	}
+	ref, err := url.Parse(include)
+	if err != nil {
+		return "", fmt.Errorf("invalid include %q: %w", include, err)
+	}
+	return base.ResolveReference(ref).String(), nil
+}
+
+// loadStaticFiles reads the files served locally instead of redirecting
+func (cfg *config) loadStaticFiles() error {
+	switch {
+	case cfg.Files.RobotsTxt != "":
+		f, err := readStaticFile("/robots.txt", "text/plain; charset=utf-8", cfg.Files.RobotsTxt)
+		if err != nil {
+			return err
+		}
+		cfg.staticFiles = append(cfg.staticFiles, f)
+	case cfg.Files.RobotsDisallowAll:
+		cfg.staticFiles = append(cfg.staticFiles, staticFile{
+			path:        "/robots.txt",
+			contentType: "text/plain; charset=utf-8",
+			content:     []byte(robotsDisallowAll),
+		})
+	}
+	if cfg.Files.Favicon != "" {
+		f, err := readStaticFile("/favicon.ico", "", cfg.Files.Favicon)
+		if err != nil {
+			return err
+		}
+		cfg.staticFiles = append(cfg.staticFiles, f)
+	}
+	associationFiles, err := appAssociationFiles(cfg.Files.AppleAppSiteAssociation, cfg.Files.AssetLinks)
+	if err != nil {
+		return err
+	}
+	cfg.staticFiles = append(cfg.staticFiles, associationFiles...)
+	return nil
+}
+
+// close releases the resources opened by prepare, it can be called more
+// than once
+func (cfg *config) close() {
+	cfg.closeOnce.Do(func() {
+		for _, c := range cfg.closers {
+			if err := c.Close(); err != nil {
+				log.Error(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// exportCommand writes the effective rules of the config built from the
+// arguments, including the rules of stores, to stdout. YAML and JSON can be
+// used as rules file, CSV can be imported. It returns the exit code.
+func exportCommand(args []string) int {
+	var format string
+	cfg, err := parseConfig(args, func(fs *flag.FlagSet) {
+		fs.StringVar(&format, "format", "yaml", "format of the exported rules, yaml, json or csv")
+	})
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+	if err := cfg.prepare(); err != nil {
+		log.Error(err)
+		return 1
+	}
+	defer cfg.close()
+
+	switch format {
+	case "yaml":
+		err = exportYAML(os.Stdout, cfg.Rules)
+	case "json":
+		err = exportJSON(os.Stdout, cfg.Rules)
+	case "csv":
+		err = exportCSV(os.Stdout, cfg.Rules)
+	default:
+		err = fmt.Errorf("invalid format %q, use yaml, json or csv", format)
+	}
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+	return 0
+}
+
+func exportYAML(w io.Writer, rules []rule) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(rules); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// exportJSON writes the rules with the keys of rules files, which are the
+// yaml names
+func exportJSON(w io.Writer, rules []rule) error {
+	var buf bytes.Buffer
+	if err := exportYAML(&buf, rules); err != nil {
+		return err
+	}
+	var v []any
+	if err := yaml.Unmarshal(buf.Bytes(), &v); err != nil {
+		return err
+	}
+	if v == nil {
+		v = []any{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// exportCSV writes the rules in the format of the import. Rules using more
+// than host, path, target and status can not be expressed and are skipped
+// with a warning.
+func exportCSV(w io.Writer, rules []rule) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"source", "destination", "status"}); err != nil {
+		return err
+	}
+	for i := range rules {
+		ru := &rules[i]
+		if !ru.csvExportable() {
+			log.Warnf("rule %s%s can not be expressed as csv, skipped", ru, sourceSuffix(ru))
+			continue
+		}
+		source := ru.Path
+		if ru.Host != "" {
+			source = "https://" + ru.Host + ru.Path
+		}
+		status := ""
+		if ru.Status != 0 {
+			status = strconv.Itoa(ru.Status)
+		}
+		if err := cw.Write([]string{source, ru.Target, status}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// csvExportable reports if the rule only consists of host, path, target and
+// status. The encoded rule is compared so new settings are covered as well.
+func (ru *rule) csvExportable() bool {
+	plain := rule{ID: ru.ID, Host: ru.Host, Path: ru.Path, Target: ru.Target, Status: ru.Status}
+	var a, b bytes.Buffer
+	if yaml.NewEncoder(&a).Encode(&plain) != nil || yaml.NewEncoder(&b).Encode(ru) != nil {
+		return false
+	}
+	return ru.Path != "" && ru.Target != "" && a.String() == b.String()
+}
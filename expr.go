@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+)
+
+// exprEnv returns the CEL environment rule expressions are compiled in. The
+// request is available as a map with the keys path, host, method, scheme,
+// query, params, headers and user_agent. Header names are lower case.
+var exprEnv = sync.OnceValues(func() (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.Variable("request", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("client_ip", cel.StringType),
+		cel.Function("ip_in_cidr",
+			cel.Overload("ip_in_cidr_string_string",
+				[]*cel.Type{cel.StringType, cel.StringType},
+				cel.BoolType,
+				cel.BinaryBinding(ipInCIDR),
+			),
+		),
+	)
+})
+
+func ipInCIDR(ip, cidr ref.Val) ref.Val {
+	_, network, err := net.ParseCIDR(fmt.Sprint(cidr.Value()))
+	if err != nil {
+		return types.NewErr("invalid cidr %v: %v", cidr.Value(), err)
+	}
+	parsed := net.ParseIP(fmt.Sprint(ip.Value()))
+	return types.Bool(parsed != nil && network.Contains(parsed))
+}
+
+func compileExpr(expr string) (cel.Program, error) {
+	env, err := exprEnv()
+	if err != nil {
+		return nil, fmt.Errorf("could not create expression environment: %w", err)
+	}
+	ast, iss := env.Compile(expr)
+	if iss.Err() != nil {
+		return nil, fmt.Errorf("invalid expression %q: %w", expr, iss.Err())
+	}
+	if ast.OutputType() != cel.BoolType {
+		return nil, fmt.Errorf("expression %q must return a bool, got %s", expr, ast.OutputType())
+	}
+	return env.Program(ast)
+}
+
+func exprVariables(r *http.Request) map[string]any {
+	headers := make(map[string]string, len(r.Header))
+	for name, values := range r.Header {
+		headers[strings.ToLower(name)] = strings.Join(values, ", ")
+	}
+	params := make(map[string]string)
+	for name, values := range r.URL.Query() {
+		params[name] = values[0]
+	}
+	return map[string]any{
+		"request": map[string]any{
+			"path":       r.URL.Path,
+			"host":       requestHost(r),
+			"method":     r.Method,
+			"scheme":     requestScheme(r),
+			"query":      r.URL.RawQuery,
+			"params":     params,
+			"headers":    headers,
+			"user_agent": r.UserAgent(),
+		},
+		"client_ip": clientIP(r),
+	}
+}
+
+// matchesExpr evaluates the expression of the rule, errors count as no
+// match
+func (ru *rule) matchesExpr(r *http.Request) bool {
+	out, _, err := ru.expr.Eval(exprVariables(r))
+	if err != nil {
+		requestLog(r).Debugf("could not evaluate expression of rule %s: %v", ru, err)
+		return false
+	}
+	matched, ok := out.Value().(bool)
+	return ok && matched
+}
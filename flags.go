@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// headerFlag collects repeated "Name: value" flags into a header map
+type headerFlag map[string]string
+
+func (h headerFlag) String() string {
+	var parts []string
+	for name, v := range h {
+		parts = append(parts, name+": "+v)
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (h headerFlag) Set(value string) error {
+	name, v, ok := strings.Cut(value, ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		return fmt.Errorf("header %q must be in the form Name: value", value)
+	}
+	h[http.CanonicalHeaderKey(name)] = strings.TrimSpace(v)
+	return nil
+}
+
+// levelsFlag parses "component=level" pairs separated by commas into a map
+type levelsFlag map[string]string
+
+func (l levelsFlag) String() string {
+	var parts []string
+	for component, level := range l {
+		parts = append(parts, component+"="+level)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (l levelsFlag) Set(value string) error {
+	for _, part := range strings.Split(value, ",") {
+		component, level, ok := strings.Cut(part, "=")
+		component = strings.TrimSpace(component)
+		if !ok || component == "" {
+			return fmt.Errorf("log level %q must be in the form component=level", part)
+		}
+		l[component] = strings.TrimSpace(level)
+	}
+	return nil
+}
+
+// listFlag parses a comma separated list
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = strings.Split(value, ",")
+	return nil
+}
+
+// certificateFlag collects repeated "cert.pem,key.pem" flags
+type certificateFlag []certificateFiles
+
+func (c *certificateFlag) String() string {
+	var parts []string
+	for _, f := range *c {
+		parts = append(parts, f.Cert+","+f.Key)
+	}
+	return strings.Join(parts, " ")
+}
+
+func (c *certificateFlag) Set(value string) error {
+	cert, key, ok := strings.Cut(value, ",")
+	if !ok || cert == "" || key == "" {
+		return fmt.Errorf("certificate %q must be in the form cert.pem,key.pem", value)
+	}
+	*c = append(*c, certificateFiles{Cert: cert, Key: key})
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// countryBlock can be used instead of a target to block visitors from a
+// country
+const countryBlock = "block"
+
+// geoLocator looks up the country of ip addresses in a MaxMind database and
+// caches the results
+type geoLocator struct {
+	reader    *geoip2.Reader
+	cacheSize int
+
+	mu    sync.Mutex
+	cache map[string]string
+}
+
+func openGeoIP(filename string, cacheSize int) (*geoLocator, error) {
+	reader, err := geoip2.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not open geoip database %s: %w", filename, err)
+	}
+	return &geoLocator{
+		reader:    reader,
+		cacheSize: cacheSize,
+		cache:     make(map[string]string),
+	}, nil
+}
+
+func (g *geoLocator) Close() error {
+	return g.reader.Close()
+}
+
+// country returns the ISO country code of the ip or an empty string if it
+// is unknown
+func (g *geoLocator) country(ip string) string {
+	g.mu.Lock()
+	code, ok := g.cache[ip]
+	g.mu.Unlock()
+	if ok {
+		return code
+	}
+
+	if parsed := net.ParseIP(ip); parsed != nil {
+		if record, err := g.reader.Country(parsed); err == nil {
+			code = record.Country.IsoCode
+		}
+	}
+
+	g.mu.Lock()
+	// simply start over once the cache is full
+	if len(g.cache) >= g.cacheSize {
+		clear(g.cache)
+	}
+	g.cache[ip] = code
+	g.mu.Unlock()
+	return code
+}
+
+// prepareCountries validates the country targets of a rule, database is the
+// configured GeoIP database which is not opened when validating only
+func prepareCountries(countries map[string]string, database string) (map[string]string, error) {
+	if len(countries) > 0 && database == "" {
+		return nil, fmt.Errorf("country targets require a geoip database")
+	}
+	normalized := make(map[string]string, len(countries))
+	for country, target := range countries {
+		if target != countryBlock {
+			if err := validateTarget(target); err != nil {
+				return nil, fmt.Errorf("country %q: %w", country, err)
+			}
+		}
+		normalized[strings.ToUpper(country)] = target
+	}
+	return normalized, nil
+}
+
+// countryTarget returns the target configured for the country of the client
+func (ru *rule) countryTarget(r *http.Request) (string, bool) {
+	if len(ru.countries) == 0 {
+		return "", false
+	}
+	target, ok := ru.countries[ru.geoip.country(clientIP(r))]
+	return target, ok
+}
+
+// countryBlocked reports if the client is from a blocked country
+func (ru *rule) countryBlocked(r *http.Request) bool {
+	target, ok := ru.countryTarget(r)
+	return ok && target == countryBlock
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// gitTimeout limits a single git command
+const gitTimeout = time.Minute
+
+// gitConfig describes a git repository containing rule files. It is checked
+// out to Directory before the config is prepared, so the files can be used
+// with rules_file and include.
+type gitConfig struct {
+	Repository string `yaml:"repository"`
+	// Branch defaults to the default branch of the repository
+	Branch    string        `yaml:"branch"`
+	Directory string        `yaml:"directory"`
+	Interval  time.Duration `yaml:"interval"`
+}
+
+// sync clones the repository or updates the checkout to the latest commit
+// of the branch and reports if the checkout changed
+func (g gitConfig) sync(ctx context.Context) (bool, error) {
+	if g.Directory == "" {
+		return false, fmt.Errorf("git repository requires a checkout directory")
+	}
+	if _, err := os.Stat(filepath.Join(g.Directory, ".git")); os.IsNotExist(err) {
+		args := []string{"clone", "--depth", "1"}
+		if g.Branch != "" {
+			args = append(args, "--branch", g.Branch)
+		}
+		if _, err := runGit(ctx, "", append(args, "--", g.Repository, g.Directory)...); err != nil {
+			return false, err
+		}
+		gitLog.Infof("cloned %s to %s", g.Repository, g.Directory)
+		return true, nil
+	}
+
+	before, err := runGit(ctx, g.Directory, "rev-parse", "HEAD")
+	if err != nil {
+		return false, err
+	}
+	ref := g.Branch
+	if ref == "" {
+		ref = "HEAD"
+	}
+	if _, err := runGit(ctx, g.Directory, "fetch", "--depth", "1", "origin", ref); err != nil {
+		return false, err
+	}
+	// the checkout is owned by the redirector, local changes are discarded
+	if _, err := runGit(ctx, g.Directory, "reset", "--hard", "FETCH_HEAD"); err != nil {
+		return false, err
+	}
+	after, err := runGit(ctx, g.Directory, "rev-parse", "HEAD")
+	if err != nil {
+		return false, err
+	}
+	if before != after {
+		gitLog.Infof("updated %s from %.12s to %.12s", g.Directory, before, after)
+	}
+	return before != after, nil
+}
+
+// runGit runs git in the directory and returns its trimmed output
+func runGit(ctx context.Context, dir string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, gitTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	// never wait for credentials on a terminal
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s failed: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// pollGit updates the checkout on every interval and reloads the config
+// once it changed
+func (app *application) pollGit(ctx context.Context, g gitConfig) {
+	ticker := time.NewTicker(g.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		changed, err := g.sync(ctx)
+		if err != nil {
+			gitLog.Errorf("could not update git repository: %v", err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+		if err := app.reload(); err != nil {
+			gitLog.Errorf("could not reload config, keeping the current one: %v", err)
+		}
+	}
+}
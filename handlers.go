@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// routes returns the handler of the main listener, it passes requests to
+// the router of the active config
+func (app *application) routes() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		(*app.router.Load()).ServeHTTP(w, r)
+	})
+}
+
+func (app *application) newRouter(cfg *config) http.Handler {
+	r := mux.NewRouter()
+	r.Use(app.requestID)
+	r.Use(app.trace)
+	r.Use(app.instrument)
+	r.Use(app.limitClients)
+	r.Use(app.realIP)
+	r.Use(app.loggingMiddleware)
+	r.Use(app.recoverPanic)
+	r.Use(app.limitBody)
+	r.Use(app.addResponseHeaders)
+	r.Use(app.healthCheck)
+	r.Use(app.maintenanceMode)
+	r.Use(app.methodFilter)
+	r.Use(app.canonicalizeHost)
+	r.Use(app.canonicalSlash)
+	app.staticRoutes(r, cfg)
+	r.PathPrefix("/").HandlerFunc(app.catchAllHandler)
+	return r
+}
+
+func (app *application) catchAllHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := app.config()
+	target, status := cfg.defaultRedirect(r)
+	for _, hook := range cfg.hooks {
+		hookTarget, hookStatus, ok, err := hook.decide(r)
+		if err != nil {
+			requestLog(r).Error(err)
+		} else if ok {
+			if hookStatus == 0 {
+				hookStatus = status
+			}
+			countRedirect(r, actionRedirect)
+			traceRedirect(r, nil, hookTarget)
+			app.redirect(w, r, hookTarget, hookStatus)
+			return
+		}
+	}
+
+	ru := matchRule(cfg.Rules, r)
+	if ru != nil {
+		countRule(r, ru)
+	}
+	if ru != nil && cfg.store != nil {
+		cfg.store.hit(ru, r)
+	}
+	if ru != nil {
+		for name, value := range ru.ResponseHeaders {
+			w.Header().Set(name, value)
+		}
+	}
+	if ru != nil && ru.expiredAt(time.Now()) {
+		app.errorPage(w, r, ru.expiredStatus)
+		return
+	}
+	if ru != nil && ru.countryBlocked(r) {
+		app.blockedHandler(w, r, ru)
+		return
+	}
+	if ru != nil && ru.Action == actionGone {
+		app.goneHandler(w, r, ru)
+		return
+	}
+	if ru != nil {
+		target = ru.expandTarget(r)
+		if ru.Status != 0 {
+			status = ru.Status
+		}
+	} else if cfg.Fallback != fallbackRedirect {
+		app.fallbackHandler(w, r)
+		return
+	}
+	location, err := cfg.buildTarget(target, r, ru)
+	if err != nil {
+		app.logError(w, r, err, false)
+		return
+	}
+	action := actionRedirect
+	if ru != nil {
+		action = ru.Action
+	}
+	cfg.setCacheHeaders(w, ru)
+	countRedirect(r, action)
+	traceRedirect(r, ru, location)
+	switch action {
+	case actionMetaRefresh:
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		renderPage(w, r, metaRefreshTemplate, http.StatusOK, location)
+	case actionJavascript:
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		renderPage(w, r, javascriptTemplate, http.StatusOK, location)
+	case actionInterstitial:
+		app.interstitialHandler(w, r, ru, location)
+	default:
+		app.redirect(w, r, location, status)
+	}
+}
+
+// interstitialHandler shows a page announcing the redirect before forwarding
+func (app *application) interstitialHandler(w http.ResponseWriter, r *http.Request, ru *rule, location string) {
+	cfg := app.config()
+	data := interstitialData{
+		Target: location,
+		Host:   location,
+		Delay:  cfg.Interstitial.Delay,
+	}
+	if u, err := url.Parse(location); err == nil && u.Host != "" {
+		data.Host = u.Host
+	}
+	if ru.Delay > 0 {
+		data.Delay = ru.Delay
+	}
+	renderPage(w, r, cfg.interstitial, http.StatusOK, data)
+}
+
+// goneHandler answers requests for retired urls with 410 Gone
+func (app *application) goneHandler(w http.ResponseWriter, r *http.Request, ru *rule) {
+	if ru.Body == "" {
+		app.errorPage(w, r, http.StatusGone)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusGone)
+	_, _ = w.Write([]byte(ru.Body))
+}
+
+// blockedHandler answers requests from blocked countries
+func (app *application) blockedHandler(w http.ResponseWriter, r *http.Request, ru *rule) {
+	if ru.Body == "" {
+		app.errorPage(w, r, http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+	_, _ = w.Write([]byte(ru.Body))
+}
+
+// fallbackHandler answers requests not matching any rule
+func (app *application) fallbackHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := app.config()
+	switch cfg.Fallback {
+	case fallbackNotFound:
+		app.errorPage(w, r, http.StatusNotFound)
+	case fallbackNoContent:
+		w.WriteHeader(http.StatusNoContent)
+	case fallbackPage:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write(cfg.fallbackPage)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultHealthPath = "/healthz"
+	defaultLivePath   = "/livez"
+	defaultReadyPath  = "/readyz"
+	// readyTimeout limits the checks of the backends of the readiness
+	// endpoint
+	readyTimeout = 2 * time.Second
+)
+
+// pinger is a backend of a hook checked by the readiness endpoint
+type pinger interface {
+	name() string
+	ping(ctx context.Context) error
+}
+
+type readyStatus struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+type healthStatus struct {
+	Status      string `json:"status"`
+	Maintenance bool   `json:"maintenance"`
+	Rules       int    `json:"rules"`
+}
+
+// healthCheck answers requests for the health, liveness and readiness
+// paths with a JSON status instead of redirecting them, so load balancers,
+// uptime monitors and Kubernetes can check the listeners. They are answered
+// in maintenance mode as the process is healthy.
+func (app *application) healthCheck(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := app.config()
+		p := r.URL.Path
+		switch {
+		case p == cfg.HealthPath && p != "":
+			w.Header().Set("Cache-Control", "no-store")
+			app.writeJSON(w, http.StatusOK, healthStatus{
+				Status:      "ok",
+				Maintenance: app.maintenance.Load(),
+				Rules:       len(cfg.Rules),
+			})
+		case p == cfg.LivePath && p != "":
+			w.Header().Set("Cache-Control", "no-store")
+			app.writeJSON(w, http.StatusOK, readyStatus{Status: "ok"})
+		case p == cfg.ReadyPath && p != "":
+			w.Header().Set("Cache-Control", "no-store")
+			status := app.readiness(r.Context(), cfg)
+			code := http.StatusOK
+			if status.Status != "ready" {
+				code = http.StatusServiceUnavailable
+			}
+			app.writeJSON(w, code, status)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// readiness checks that all listeners are started and not shutting down,
+// the backends of the config are reachable and the certificates are valid
+func (app *application) readiness(ctx context.Context, cfg *config) readyStatus {
+	checks := make(map[string]string)
+	if app.ready.Load() {
+		checks["listeners"] = "ok"
+	} else {
+		checks["listeners"] = "starting or shutting down"
+	}
+	ctx, cancel := context.WithTimeout(ctx, readyTimeout)
+	defer cancel()
+	if cfg.store != nil {
+		checks["store"] = checkResult(cfg.store.ping(ctx))
+	}
+	for _, h := range cfg.hooks {
+		if p, ok := h.(pinger); ok {
+			checks[p.name()] = checkResult(p.ping(ctx))
+		}
+	}
+	if cfg.geoip != nil {
+		checks["geoip"] = "ok"
+	}
+	if certs := app.certificates.Load(); certs != nil && len(*certs) > 0 {
+		checks["certificates"] = "ok"
+		now := time.Now()
+		for name, set := range *certs {
+			for _, c := range set {
+				if c.Leaf != nil && now.After(c.Leaf.NotAfter) {
+					checks["certificates"] = fmt.Sprintf("certificate %s of listener %s expired on %s", c.Leaf.Subject.CommonName, name, c.Leaf.NotAfter.Format(time.RFC3339))
+				}
+			}
+		}
+	}
+	status := readyStatus{Status: "ready", Checks: checks}
+	for _, result := range checks {
+		if result != "ok" {
+			status.Status = "not ready"
+		}
+	}
+	return status
+}
+
+func checkResult(err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return "ok"
+}
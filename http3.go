@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// newHTTP3Server returns a HTTP/3 server on the UDP port of the TLS listener
+// using its handler, certificates and idle timeout
+func newHTTP3Server(srv *http.Server) *http3.Server {
+	return &http3.Server{
+		Addr:        srv.Addr,
+		Handler:     srv.Handler,
+		TLSConfig:   http3.ConfigureTLSConfig(srv.TLSConfig),
+		IdleTimeout: srv.IdleTimeout,
+	}
+}
+
+// advertiseHTTP3 adds the Alt-Svc header announcing HTTP/3 to the responses
+// of the TCP listener, so clients can switch for their next requests
+func advertiseHTTP3(h3 *http3.Server, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor < 3 {
+			if err := h3.SetQUICHeaders(w.Header()); err != nil {
+				log.Debugf("could not set Alt-Svc header: %v", err)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// maxImportSize limits the size of CSV files imported through the admin api
+const maxImportSize = 10 << 20
+
+// importedRule is a rule read from a CSV row, its id is the host and path
+// of the source so importing a file again replaces the rules
+type importedRule struct {
+	id    string
+	value json.RawMessage
+}
+
+// parseImportCSV reads rows of source,destination,status. The source is a
+// path or an absolute URL, the status is optional and further columns are
+// ignored. The first row is skipped if it is a header. Every row is checked
+// against the config, errors name the row.
+func parseImportCSV(r io.Reader, cfg *config) ([]importedRule, []error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	var rules []importedRule
+	var errs []error
+	rows := make(map[string]int)
+	for row := 1; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, append(errs, err)
+		}
+		if row == 1 && len(record) > 0 && !strings.HasPrefix(record[0], "/") && !isURL(record[0]) {
+			continue
+		}
+		ir, err := importRow(record, cfg)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("row %d: %w", row, err))
+			continue
+		}
+		if prev, ok := rows[ir.id]; ok {
+			errs = append(errs, fmt.Errorf("row %d: source %s duplicates row %d", row, ir.id, prev))
+			continue
+		}
+		rows[ir.id] = row
+		rules = append(rules, ir)
+	}
+	return rules, errs
+}
+
+func importRow(record []string, cfg *config) (importedRule, error) {
+	if len(record) < 2 {
+		return importedRule{}, fmt.Errorf("expected source,destination,status")
+	}
+	source, target := strings.TrimSpace(record[0]), strings.TrimSpace(record[1])
+	fields := map[string]any{"target": target}
+	var host, path string
+	switch {
+	case strings.HasPrefix(source, "/"):
+		path = source
+	case isURL(source):
+		u, err := url.Parse(source)
+		if err != nil || u.Host == "" {
+			return importedRule{}, fmt.Errorf("invalid source %q", source)
+		}
+		host, path = strings.ToLower(u.Hostname()), u.Path
+		if path == "" {
+			path = "/"
+		}
+		fields["host"] = host
+	default:
+		return importedRule{}, fmt.Errorf("source %q must be a path or an URL", source)
+	}
+	if strings.Contains(source, "?") {
+		return importedRule{}, fmt.Errorf("source %q must not contain a query string", source)
+	}
+	fields["path"] = path
+	if len(record) > 2 && strings.TrimSpace(record[2]) != "" {
+		status, err := strconv.Atoi(strings.TrimSpace(record[2]))
+		if err != nil {
+			return importedRule{}, fmt.Errorf("invalid status %q", record[2])
+		}
+		fields["status"] = status
+	}
+
+	value, err := json.Marshal(fields)
+	if err != nil {
+		return importedRule{}, err
+	}
+	ir := importedRule{id: host + path, value: value}
+	var ru rule
+	if err := decodeStoredRule(&ru, ir.id, value); err != nil {
+		return importedRule{}, err
+	}
+	if err := ru.prepare(cfg); err != nil {
+		return importedRule{}, err
+	}
+	return ir, nil
+}
+
+// importRules stores the rules and calls apply to check the config with
+// them. The previous rules are restored if apply fails.
+func (s *ruleStore) importRules(rules []importedRule, apply func() error) error {
+	old := make([]json.RawMessage, 0, len(rules))
+	revert := func() {
+		for i, value := range old {
+			var err error
+			if value != nil {
+				_, err = s.putRule(rules[i].id, value)
+			} else {
+				_, err = s.deleteRule(rules[i].id)
+			}
+			if err != nil {
+				log.Errorf("could not revert rule %s: %v", rules[i].id, err)
+			}
+		}
+	}
+	for _, ir := range rules {
+		prev, err := s.putRule(ir.id, ir.value)
+		if err != nil {
+			revert()
+			return err
+		}
+		old = append(old, prev)
+	}
+	if err := apply(); err != nil {
+		revert()
+		return err
+	}
+	return nil
+}
+
+// importCommand imports a CSV file into the store of the config built from
+// the arguments, - reads from stdin. Running redirectors pick up the rules on
+// their next reload. It returns the exit code.
+func importCommand(args []string) int {
+	cfg, err := parseConfig(args)
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+	if len(cfg.args) != 1 {
+		log.Error("usage: redirector import [flags] <file.csv>")
+		return 1
+	}
+	if cfg.Store == "" {
+		log.Error("import requires a store")
+		return 1
+	}
+	if err := cfg.prepare(); err != nil {
+		log.Error(err)
+		return 1
+	}
+	defer cfg.close()
+
+	in := os.Stdin
+	if name := cfg.args[0]; name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			log.Error(err)
+			return 1
+		}
+		defer f.Close()
+		in = f
+	}
+	rules, errs := parseImportCSV(in, cfg)
+	if len(errs) > 0 {
+		for _, err := range errs {
+			log.Error(err)
+		}
+		log.Errorf("%d invalid rows, nothing imported", len(errs))
+		return 1
+	}
+	err = cfg.store.importRules(rules, func() error {
+		check, err := parseConfig(args)
+		if err != nil {
+			return err
+		}
+		defer check.close()
+		return check.prepare()
+	})
+	if err != nil {
+		log.Errorf("could not import rules: %v", err)
+		return 1
+	}
+	log.Infof("imported %d rules into %s", len(rules), cfg.store.name)
+	return 0
+}
+
+type importResult struct {
+	Imported int      `json:"imported"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+// importHandler imports a CSV file sent as body into the store and reloads
+// the config. Nothing is imported if a row is invalid.
+func (app *application) importHandler(w http.ResponseWriter, r *http.Request) {
+	store := app.store(w)
+	if store == nil {
+		return
+	}
+	rules, errs := parseImportCSV(http.MaxBytesReader(w, r.Body, maxImportSize), app.config())
+	if len(errs) > 0 {
+		result := importResult{}
+		for _, err := range errs {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+			result.Errors = append(result.Errors, err.Error())
+		}
+		app.writeJSON(w, http.StatusBadRequest, result)
+		return
+	}
+
+	app.storeMu.Lock()
+	defer app.storeMu.Unlock()
+	if err := store.importRules(rules, app.reload); err != nil {
+		app.writeJSON(w, http.StatusBadRequest, importResult{Errors: []string{err.Error()}})
+		return
+	}
+	log.Infof("imported %d rules", len(rules))
+	app.writeJSON(w, http.StatusOK, importResult{Imported: len(rules)})
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	k8sServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	// k8sRedirectAPI is the api group and version of the Redirect resource
+	k8sRedirectAPI = "/apis/redirector.firefart.github.io/v1"
+	// k8sWatchTimeout is the number of seconds a watch request stays open
+	k8sWatchTimeout = "300"
+)
+
+// k8sStore reads rules from a ConfigMap, every data key holding rules like
+// a key value store, or from Redirect custom resources whose spec is a rule.
+type k8sStore struct {
+	api       string
+	tokenFile string
+	client    *http.Client
+	// path lists the resources, name selects a single ConfigMap
+	path string
+	name string
+}
+
+// newK8sStore parses k8s://configmap/<namespace>/<name> and
+// k8s://redirects/<namespace>. The in cluster service account is used
+// unless the api parameter points to another API server, e.g. kubectl proxy
+// with ?api=http://127.0.0.1:8001.
+func newK8sStore(u *url.URL) (*k8sStore, error) {
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	s := &k8sStore{api: u.Query().Get("api"), client: kvClient}
+	switch {
+	case u.Host == "configmap" && len(parts) == 2:
+		s.path = "/api/v1/namespaces/" + parts[0] + "/configmaps"
+		s.name = parts[1]
+	case u.Host == "redirects" && len(parts) == 1 && parts[0] != "":
+		s.path = k8sRedirectAPI + "/namespaces/" + parts[0] + "/redirects"
+	default:
+		return nil, fmt.Errorf("kubernetes source must be k8s://configmap/<namespace>/<name> or k8s://redirects/<namespace>")
+	}
+	if s.api != "" {
+		return s, nil
+	}
+
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a kubernetes cluster, use the api parameter to set the API server")
+	}
+	ca, err := os.ReadFile(k8sServiceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("could not read service account ca: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("invalid service account ca")
+	}
+	s.api = "https://" + net.JoinHostPort(host, port)
+	s.tokenFile = k8sServiceAccountDir + "/token"
+	s.client = &http.Client{Transport: newKVTransport(&tls.Config{RootCAs: pool})}
+	return s, nil
+}
+
+func (s *k8sStore) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	u := s.api + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if s.tokenFile != "" {
+		// projected tokens are rotated, always use the current one
+		token, err := os.ReadFile(s.tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read service account token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+type k8sMetadata struct {
+	Name            string `json:"name"`
+	ResourceVersion string `json:"resourceVersion"`
+}
+
+// k8sObject is a ConfigMap or a Redirect
+type k8sObject struct {
+	Metadata k8sMetadata       `json:"metadata"`
+	Data     map[string]string `json:"data"`
+	Spec     json.RawMessage   `json:"spec"`
+}
+
+func (s *k8sStore) list(ctx context.Context) ([]kvPair, string, error) {
+	if s.name != "" {
+		resp, err := s.get(ctx, s.path+"/"+s.name, nil)
+		if err != nil {
+			return nil, "", err
+		}
+		defer resp.Body.Close()
+		var cm k8sObject
+		if err := json.NewDecoder(resp.Body).Decode(&cm); err != nil {
+			return nil, "", err
+		}
+		pairs := make([]kvPair, 0, len(cm.Data))
+		for key, value := range cm.Data {
+			pairs = append(pairs, kvPair{key: key, value: []byte(value)})
+		}
+		sort.Slice(pairs, func(i, j int) bool { return pairs[i].key < pairs[j].key })
+		return pairs, cm.Metadata.ResourceVersion, nil
+	}
+
+	resp, err := s.get(ctx, s.path, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	var list struct {
+		Metadata k8sMetadata `json:"metadata"`
+		Items    []k8sObject `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, "", err
+	}
+	pairs := make([]kvPair, 0, len(list.Items))
+	for _, item := range list.Items {
+		pairs = append(pairs, kvPair{key: item.Metadata.Name, value: item.Spec})
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].key < pairs[j].key })
+	return pairs, list.Metadata.ResourceVersion, nil
+}
+
+// wait watches the resources until one of them changes. The index is
+// returned unchanged if the watch timed out without changes.
+func (s *k8sStore) wait(ctx context.Context, index string) (string, error) {
+	query := url.Values{
+		"watch":           {"true"},
+		"resourceVersion": {index},
+		"timeoutSeconds":  {k8sWatchTimeout},
+	}
+	if s.name != "" {
+		query.Set("fieldSelector", "metadata.name="+s.name)
+	}
+	resp, err := s.get(ctx, s.path, query)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var event struct {
+			Type   string    `json:"type"`
+			Object k8sObject `json:"object"`
+		}
+		if err := dec.Decode(&event); err != nil {
+			if err == io.EOF {
+				return index, nil
+			}
+			return "", err
+		}
+		switch event.Type {
+		case "BOOKMARK":
+		case "ERROR":
+			// usually 410 Gone as the version is too old, list again
+			return "", nil
+		default:
+			return event.Object.Metadata.ResourceVersion, nil
+		}
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.yaml.in/yaml/v3"
+)
+
+const (
+	// kvWaitTime is the maximum time a consul blocking query waits
+	kvWaitTime = 5 * time.Minute
+	// kvRetryDelay is the delay before watching again after an error
+	kvRetryDelay = 5 * time.Second
+)
+
+// kvClient is used for all requests to key value stores instead of
+// http.DefaultClient, which waits forever for unreachable servers
+var kvClient = &http.Client{Transport: newKVTransport(nil)}
+
+// newKVTransport returns a transport with timeouts for connecting and for
+// the response headers. The header timeout leaves room for consul blocking
+// queries, which answer after up to kvWaitTime plus a sixteenth of it.
+func newKVTransport(tlsConfig *tls.Config) *http.Transport {
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: remoteTimeout, KeepAlive: 30 * time.Second}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   remoteTimeout,
+		ResponseHeaderTimeout: kvWaitTime + kvWaitTime/16 + remoteTimeout,
+		IdleConnTimeout:       90 * time.Second,
+	}
+}
+
+// kvPair is a key and its value in a key value store
+type kvPair struct {
+	key   string
+	value []byte
+}
+
+// kvStore is a key value store holding the rules below a prefix, every key
+// contains a single rule or a list of rules
+type kvStore interface {
+	// list returns the pairs below the prefix sorted by key and the index
+	// of the data, an opaque version like a revision
+	list(ctx context.Context) ([]kvPair, string, error)
+	// wait blocks until the data below the prefix changed after index and
+	// returns the new index
+	wait(ctx context.Context, index string) (string, error)
+}
+
+func isKV(name string) bool {
+	return strings.HasPrefix(name, "etcd://") || strings.HasPrefix(name, "consul://") || strings.HasPrefix(name, "k8s://")
+}
+
+// isURL reports if the name refers to a remote source instead of a file
+func isURL(name string) bool {
+	return strings.Contains(name, "://")
+}
+
+// newKVStore parses a store URL like etcd://127.0.0.1:2379/redirector/ or
+// consul://127.0.0.1:8500/redirector/. The query parameter tls=true
+// connects using https. Kubernetes sources are described in newK8sStore.
+func newKVStore(name string) (kvStore, error) {
+	u, err := url.Parse(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key value store %q: %w", name, err)
+	}
+	scheme := "http"
+	if tls, _ := strconv.ParseBool(u.Query().Get("tls")); tls {
+		scheme = "https"
+	}
+	base := scheme + "://" + u.Host
+	prefix := strings.TrimPrefix(u.Path, "/")
+	switch u.Scheme {
+	case "etcd":
+		return &etcdStore{endpoint: base, prefix: prefix}, nil
+	case "consul":
+		return &consulStore{endpoint: base, prefix: prefix, token: os.Getenv("CONSUL_HTTP_TOKEN")}, nil
+	case "k8s":
+		return newK8sStore(u)
+	}
+	return nil, fmt.Errorf("unsupported key value store %q", name)
+}
+
+// loadKVRules reads the rules below the prefix of the store
+func loadKVRules(name string) ([]rule, error) {
+	store, err := newKVStore(name)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), remoteTimeout)
+	defer cancel()
+	pairs, _, err := store.list(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not read rules from %s: %w", name, err)
+	}
+	base, _, _ := strings.Cut(name, "?")
+	var rules []rule
+	for _, p := range pairs {
+		source := strings.TrimSuffix(base, "/") + "/" + p.key
+		parsed, err := decodeKVRules(p.value)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse rules from %s: %w", source, err)
+		}
+		for i := range parsed {
+			parsed[i].source = source
+		}
+		rules = append(rules, parsed...)
+	}
+	return rules, nil
+}
+
+// decodeKVRules decodes a single rule or a list of rules, environment
+// variables are not expanded as the store can be written by others
+func decodeKVRules(value []byte) ([]rule, error) {
+	var node yaml.Node
+	if err := yaml.Unmarshal(value, &node); err != nil {
+		return nil, err
+	}
+	if len(node.Content) == 0 {
+		return nil, nil
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(value))
+	dec.KnownFields(true)
+	if node.Content[0].Kind == yaml.SequenceNode {
+		var rules []rule
+		err := dec.Decode(&rules)
+		return rules, err
+	}
+	rules := make([]rule, 1)
+	err := dec.Decode(&rules[0])
+	return rules, err
+}
+
+// kvSources returns the key value stores the config reads rules from
+func (cfg *config) kvSources() []string {
+	var sources []string
+	for _, name := range append([]string{cfg.RulesFile}, cfg.includes...) {
+		if isKV(name) {
+			sources = append(sources, name)
+		}
+	}
+	return sources
+}
+
+// startKVWatchers watches every key value store of the active config that
+// is not watched yet. Watchers stop once their store is no longer used.
+func (app *application) startKVWatchers() {
+	app.kvWatchersMu.Lock()
+	defer app.kvWatchersMu.Unlock()
+	if app.kvWatchers == nil {
+		app.kvWatchers = make(map[string]bool)
+	}
+	for _, name := range app.config().kvSources() {
+		if !app.kvWatchers[name] {
+			app.kvWatchers[name] = true
+			go app.watchKV(name)
+		}
+	}
+}
+
+// watchKV reloads the config whenever the rules in the store change
+func (app *application) watchKV(name string) {
+	defer func() {
+		app.kvWatchersMu.Lock()
+		delete(app.kvWatchers, name)
+		app.kvWatchersMu.Unlock()
+	}()
+	store, err := newKVStore(name)
+	if err != nil {
+		kvLog.Error(err)
+		return
+	}
+	ctx := app.background
+	var index string
+	for ctx.Err() == nil {
+		if index == "" {
+			listCtx, cancel := context.WithTimeout(ctx, remoteTimeout)
+			_, index, err = store.list(listCtx)
+			cancel()
+			if err != nil {
+				kvLog.Errorf("could not read rules from %s: %v", name, err)
+				sleepContext(ctx, kvRetryDelay)
+				continue
+			}
+		}
+		next, err := store.wait(ctx, index)
+		if err != nil {
+			if ctx.Err() == nil {
+				kvLog.Errorf("could not watch %s: %v", name, err)
+				index = ""
+				sleepContext(ctx, kvRetryDelay)
+			}
+			continue
+		}
+		if next == index {
+			continue
+		}
+		index = next
+		if !slices.Contains(app.config().kvSources(), name) {
+			return
+		}
+		kvLog.Infof("rules in %s changed", name)
+		if err := app.reload(); err != nil {
+			kvLog.Errorf("could not reload config, keeping the current one: %v", err)
+		}
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
+
+// etcdStore reads rules from etcd using the JSON gateway of the v3 api
+type etcdStore struct {
+	endpoint string
+	prefix   string
+}
+
+type etcdResponseHeader struct {
+	Revision string `json:"revision"`
+}
+
+func (s *etcdStore) rangeRequest() map[string]string {
+	return map[string]string{
+		"key":       base64.StdEncoding.EncodeToString([]byte(s.prefix)),
+		"range_end": base64.StdEncoding.EncodeToString(prefixEnd([]byte(s.prefix))),
+	}
+}
+
+func (s *etcdStore) post(ctx context.Context, path string, body any) (*http.Response, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint+path, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	// the watch stream has no overall timeout
+	resp, err := kvClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp, nil
+}
+
+func (s *etcdStore) list(ctx context.Context) ([]kvPair, string, error) {
+	resp, err := s.post(ctx, "/v3/kv/range", s.rangeRequest())
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Header etcdResponseHeader `json:"header"`
+		KVs    []struct {
+			Key   []byte `json:"key"`
+			Value []byte `json:"value"`
+		} `json:"kvs"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, "", err
+	}
+	pairs := make([]kvPair, 0, len(result.KVs))
+	for _, kv := range result.KVs {
+		pairs = append(pairs, kvPair{key: strings.TrimPrefix(string(kv.Key), s.prefix), value: kv.Value})
+	}
+	return pairs, result.Header.Revision, nil
+}
+
+func (s *etcdStore) wait(ctx context.Context, index string) (string, error) {
+	revision, err := strconv.ParseUint(index, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid revision %q", index)
+	}
+	create := s.rangeRequest()
+	create["start_revision"] = strconv.FormatUint(revision+1, 10)
+	resp, err := s.post(ctx, "/v3/watch", map[string]any{"create_request": create})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			Result struct {
+				Header   etcdResponseHeader `json:"header"`
+				Events   []json.RawMessage  `json:"events"`
+				Canceled bool               `json:"canceled"`
+			} `json:"result"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return "", fmt.Errorf("watch stream closed")
+			}
+			return "", err
+		}
+		if msg.Result.Canceled {
+			// e.g. the revision was compacted, start over with a fresh list
+			return "", fmt.Errorf("watch canceled")
+		}
+		if len(msg.Result.Events) > 0 {
+			return msg.Result.Header.Revision, nil
+		}
+	}
+}
+
+// prefixEnd returns the end of the etcd key range covering the prefix
+func prefixEnd(prefix []byte) []byte {
+	end := bytes.Clone(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	// the prefix only consists of 0xff bytes, range to the end of the keys
+	return []byte{0}
+}
+
+// consulStore reads rules from the consul kv store using blocking queries
+type consulStore struct {
+	endpoint string
+	prefix   string
+	token    string
+}
+
+func (s *consulStore) get(ctx context.Context, index uint64) ([]kvPair, uint64, error) {
+	query := url.Values{"recurse": {"true"}}
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", kvWaitTime.String())
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.endpoint+"/v1/kv/"+s.prefix+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if s.token != "" {
+		req.Header.Set("X-Consul-Token", s.token)
+	}
+	resp, err := kvClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return nil, 0, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	newIndex, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid X-Consul-Index %q", resp.Header.Get("X-Consul-Index"))
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		// no keys below the prefix
+		return nil, newIndex, nil
+	}
+	var entries []struct {
+		Key   string `json:"Key"`
+		Value []byte `json:"Value"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, 0, err
+	}
+	pairs := make([]kvPair, 0, len(entries))
+	for _, e := range entries {
+		// folders are keys without a value
+		if strings.HasSuffix(e.Key, "/") && len(e.Value) == 0 {
+			continue
+		}
+		pairs = append(pairs, kvPair{key: strings.TrimPrefix(e.Key, s.prefix), value: e.Value})
+	}
+	return pairs, newIndex, nil
+}
+
+func (s *consulStore) list(ctx context.Context) ([]kvPair, string, error) {
+	pairs, index, err := s.get(ctx, 0)
+	return pairs, strconv.FormatUint(index, 10), err
+}
+
+func (s *consulStore) wait(ctx context.Context, index string) (string, error) {
+	current, err := strconv.ParseUint(index, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid index %q", index)
+	}
+	_, newIndex, err := s.get(ctx, current)
+	if err != nil {
+		return "", err
+	}
+	// consul documents that the index can go backwards, e.g. after a
+	// snapshot restore. Like any other new index it is reported as a change
+	// so the restored rules are loaded, an index of 0 would not block.
+	return strconv.FormatUint(max(newIndex, 1), 10), nil
+}
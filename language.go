@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type languageRange struct {
+	tag string
+	q   float64
+}
+
+// parseAcceptLanguage returns the language ranges of an Accept-Language
+// header sorted by their quality, highest first. Ranges with q=0 are
+// dropped.
+func parseAcceptLanguage(header string) []languageRange {
+	var ranges []languageRange
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			name, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if !ok || strings.TrimSpace(name) != "q" {
+				continue
+			}
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil || parsed < 0 || parsed > 1 {
+				parsed = 0
+			}
+			q = parsed
+		}
+		if q > 0 {
+			ranges = append(ranges, languageRange{tag: tag, q: q})
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].q > ranges[j].q
+	})
+	return ranges
+}
+
+func prepareLanguages(languages map[string]string) (map[string]string, error) {
+	normalized := make(map[string]string, len(languages))
+	for lang, target := range languages {
+		if err := validateTarget(target); err != nil {
+			return nil, fmt.Errorf("language %q: %w", lang, err)
+		}
+		normalized[strings.ToLower(lang)] = target
+	}
+	return normalized, nil
+}
+
+// languageTarget returns the target for the most preferred language of the
+// request that has a target configured. A range like de-at also matches a
+// target for de.
+func (ru *rule) languageTarget(r *http.Request) (string, bool) {
+	if len(ru.languages) == 0 {
+		return "", false
+	}
+	for _, lr := range parseAcceptLanguage(r.Header.Get("Accept-Language")) {
+		if target, ok := ru.languages[lr.tag]; ok {
+			return target, true
+		}
+		if primary, _, ok := strings.Cut(lr.tag, "-"); ok {
+			if target, ok := ru.languages[primary]; ok {
+				return target, true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+)
+
+const (
+	defaultMaxHeaderBytes = 64 << 10
+	defaultMaxBodyBytes   = 64 << 10
+)
+
+type limitsConfig struct {
+	// MaxHeaderBytes is the maximum size of the request line and headers
+	MaxHeaderBytes int `yaml:"max_header_bytes"`
+	// MaxConnections is the maximum number of concurrent connections of all
+	// listeners except the admin listener, unlimited if 0
+	MaxConnections int `yaml:"max_connections"`
+	// MaxConnectionsPerIP is the maximum number of concurrent connections
+	// of a client address, unlimited if 0
+	MaxConnectionsPerIP int `yaml:"max_connections_per_ip"`
+	// MaxBodyBytes is the maximum size of request bodies, which are read
+	// and discarded so the connection can be reused
+	MaxBodyBytes int64 `yaml:"max_body_bytes"`
+}
+
+// connLimiter is a semaphore shared by the listeners limiting the number of
+// concurrent connections, nil if unlimited
+type connLimiter chan struct{}
+
+func newConnLimiter(n int) connLimiter {
+	if n <= 0 {
+		return nil
+	}
+	return make(connLimiter, n)
+}
+
+// listener waits for a free connection before accepting the next one, so
+// further connections queue in the backlog of the socket
+func (l connLimiter) listener(ln net.Listener) net.Listener {
+	if l == nil {
+		return ln
+	}
+	return &limitListener{Listener: ln, sem: l, closed: make(chan struct{})}
+}
+
+type limitListener struct {
+	net.Listener
+	sem       connLimiter
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	select {
+	case l.sem <- struct{}{}:
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+	c, err := l.Listener.Accept()
+	if err != nil {
+		<-l.sem
+		return nil, err
+	}
+	return &limitConn{Conn: c, release: sync.OnceFunc(func() { <-l.sem })}, nil
+}
+
+// Close also ends an Accept waiting for a free connection
+func (l *limitListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return l.Listener.Close()
+}
+
+// limitConn frees its place in the limiter when it is closed
+type limitConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.release()
+	return err
+}
+
+// ipConnLimiter limits the concurrent connections of each client address
+// over all listeners, nil if unlimited
+type ipConnLimiter struct {
+	max   int
+	mu    sync.Mutex
+	ips   map[string]int
+	conns map[net.Conn]*clientConn
+}
+
+// clientConn is a connection counted for its client address once its first
+// request arrived, so the PROXY header has been read
+type clientConn struct {
+	ip       string
+	rejected bool
+}
+
+type clientConnKey struct{}
+
+func newIPConnLimiter(n int) *ipConnLimiter {
+	if n <= 0 {
+		return nil
+	}
+	return &ipConnLimiter{max: n, ips: make(map[string]int), conns: make(map[net.Conn]*clientConn)}
+}
+
+// connContext is the ConnContext hook of the servers registering new
+// connections. It runs before the PROXY header is read, so the address is
+// taken from the first request.
+func (l *ipConnLimiter) connContext(ctx context.Context, c net.Conn) context.Context {
+	cc := &clientConn{}
+	l.mu.Lock()
+	l.conns[c] = cc
+	l.mu.Unlock()
+	return context.WithValue(ctx, clientConnKey{}, cc)
+}
+
+// connState is the ConnState hook of the servers releasing closed
+// connections
+func (l *ipConnLimiter) connState(c net.Conn, state http.ConnState) {
+	if state != http.StateClosed && state != http.StateHijacked {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	cc, ok := l.conns[c]
+	if !ok {
+		return
+	}
+	delete(l.conns, c)
+	if cc.ip != "" {
+		if l.ips[cc.ip]--; l.ips[cc.ip] <= 0 {
+			delete(l.ips, cc.ip)
+		}
+	}
+}
+
+// allow counts the connection of the request for its client address and
+// reports if it is within the limit. Connections over unix domain sockets
+// are not counted.
+func (l *ipConnLimiter) allow(r *http.Request) bool {
+	cc, ok := r.Context().Value(clientConnKey{}).(*clientConn)
+	if !ok {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if cc.ip == "" {
+		ip := clientIP(r)
+		if net.ParseIP(ip) == nil {
+			return true
+		}
+		cc.ip = ip
+		l.ips[ip]++
+		cc.rejected = l.ips[ip] > l.max
+	}
+	return !cc.rejected
+}
+
+// limitClients answers requests on connections beyond the limit of their
+// client address with 429 and closes the connection. It runs before the
+// forwarding headers are applied as the limit is about connections.
+func (app *application) limitClients(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l := app.clientConnections; l != nil && !l.allow(r) {
+			requestLog(r).Debugf("rejecting connection from %s, too many connections", clientIP(r))
+			w.Header().Set("Connection", "close")
+			app.errorPage(w, r, http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// configureServer applies the timeouts and the header limit to the server
+func (cfg *config) configureServer(srv *http.Server) {
+	cfg.Timeouts.apply(srv)
+	srv.MaxHeaderBytes = cfg.Limits.MaxHeaderBytes
+}
+
+// limitBody answers requests announcing a body larger than the limit with
+// 413 and discards the bodies of other requests after they are handled. A
+// body turning out to be larger closes the connection.
+func (app *application) limitBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := app.config().Limits.MaxBodyBytes
+		if limit <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.ContentLength > limit {
+			w.Header().Set("Connection", "close")
+			app.errorPage(w, r, http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+		_, _ = io.Copy(io.Discard, r.Body)
+	})
+}
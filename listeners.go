@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// mainListener is the name of the listener configured with listen and tls
+// in the listeners of rules
+const mainListener = "main"
+
+// listenerConfig is a further listener served by the same process with its
+// own address, TLS settings and default redirect
+type listenerConfig struct {
+	// Name identifies the listener in the listeners of rules
+	Name    string `yaml:"name"`
+	Address string `yaml:"address"`
+	// TLS supports certificate files, ACME is only available on the main
+	// listener
+	TLS tlsConfig `yaml:"tls"`
+	// Redirect and Status override the default redirect of requests not
+	// matching a rule
+	Redirect string `yaml:"redirect"`
+	Status   int    `yaml:"status"`
+	// ProxyProtocol reads the PROXY protocol header of load balancers, the
+	// sources are limited by listen.proxy_protocol_from
+	ProxyProtocol bool `yaml:"proxy_protocol"`
+
+	tlsParameters tlsParameters
+}
+
+type listenerKey struct{}
+
+// listenerName returns the name of the listener that received the request
+func listenerName(r *http.Request) string {
+	return listenerFromContext(r.Context())
+}
+
+// listenerFromContext returns the name of the listener of a request context
+func listenerFromContext(ctx context.Context) string {
+	if name, ok := ctx.Value(listenerKey{}).(string); ok {
+		return name
+	}
+	return mainListener
+}
+
+// listener returns the further listener with the name
+func (cfg *config) listener(name string) *listenerConfig {
+	for i := range cfg.Listeners {
+		if cfg.Listeners[i].Name == name {
+			return &cfg.Listeners[i]
+		}
+	}
+	return nil
+}
+
+// defaultRedirect returns the target and status of requests not matching a
+// rule on the listener of the request
+func (cfg *config) defaultRedirect(r *http.Request) (string, int) {
+	target, status := cfg.Redirect, cfg.Status
+	if l := cfg.listener(listenerName(r)); l != nil {
+		if l.Redirect != "" {
+			target = l.Redirect
+		}
+		if l.Status != 0 {
+			status = l.Status
+		}
+	}
+	return target, status
+}
+
+func (cfg *config) prepareListeners() error {
+	addresses := map[string]bool{cfg.Listen.Address: true}
+	for _, a := range []string{cfg.Listen.Admin, cfg.Listen.HTTPSRedirect, cfg.TLS.ACME.HTTP} {
+		if a != "" {
+			addresses[a] = true
+		}
+	}
+	names := make(map[string]bool)
+	for i := range cfg.Listeners {
+		l := &cfg.Listeners[i]
+		if l.Name == "" || l.Name == mainListener || names[l.Name] {
+			return fmt.Errorf("listener %d needs a unique name other than %s", i+1, mainListener)
+		}
+		names[l.Name] = true
+		if l.Address == "" || addresses[l.Address] {
+			return fmt.Errorf("listener %s needs its own address", l.Name)
+		}
+		addresses[l.Address] = true
+		if l.Redirect != "" {
+			if err := validateTarget(l.Redirect); err != nil {
+				return fmt.Errorf("listener %s: %w", l.Name, err)
+			}
+		}
+		if l.Status != 0 && !validRedirectStatus(l.Status) {
+			return fmt.Errorf("listener %s has invalid redirect status code %d", l.Name, l.Status)
+		}
+		if l.TLS.ACME.Enabled {
+			return fmt.Errorf("listener %s: acme is only available on the main listener", l.Name)
+		}
+		if l.TLS.enabled() {
+			params, err := l.TLS.parameters()
+			if err != nil {
+				return fmt.Errorf("listener %s: %w", l.Name, err)
+			}
+			l.tlsParameters = params
+		}
+	}
+	return nil
+}
+
+// startListeners starts the further listeners of the config with the
+// handler of the main listener
+func (app *application) startListeners(cfg *config) []*http.Server {
+	var servers []*http.Server
+	for _, l := range cfg.Listeners {
+		srv := &http.Server{
+			Addr:    l.Address,
+			Handler: app.routes(),
+			BaseContext: func(net.Listener) context.Context {
+				return context.WithValue(context.Background(), listenerKey{}, l.Name)
+			},
+			Protocols: new(http.Protocols),
+		}
+		cfg.configureServer(srv)
+		srv.Protocols.SetHTTP1(true)
+		if l.TLS.enabled() {
+			srv.Protocols.SetHTTP2(true)
+			srv.TLSConfig = app.certificateTLSConfig(l.Name, l.tlsParameters)
+			log.Infof("Starting listener %s on %s with TLS", l.Name, l.Address)
+		} else {
+			log.Infof("Starting listener %s on %s", l.Name, l.Address)
+		}
+		app.serve(srv, serveOptions{proxyProtocol: l.ProxyProtocol, limited: true})
+		servers = append(servers, srv)
+	}
+	return servers
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+const (
+	logOutputStdout = "stdout"
+	logOutputStderr = "stderr"
+	// defaultLogMaxSize is the size in megabytes log files are rotated at
+	defaultLogMaxSize = 100
+)
+
+// logRotation are the rotation and retention settings of log files
+type logRotation struct {
+	// MaxSize is the size in megabytes a file is rotated at, 100 if 0
+	MaxSize int `yaml:"max_size"`
+	// Interval rotates the file after this time regardless of its size,
+	// e.g. 24h, disabled if 0
+	Interval time.Duration `yaml:"interval"`
+	// MaxAge removes rotated files older than this, rounded up to days,
+	// MaxBackups is the number of rotated files kept, both unlimited if 0
+	MaxAge     time.Duration `yaml:"max_age"`
+	MaxBackups int           `yaml:"max_backups"`
+	// Compress gzips the rotated files
+	Compress bool `yaml:"compress"`
+}
+
+func (r logRotation) validate() error {
+	if r.MaxSize < 0 || r.Interval < 0 || r.MaxAge < 0 || r.MaxBackups < 0 {
+		return fmt.Errorf("log rotation settings must not be negative")
+	}
+	return nil
+}
+
+// rotatingFile is a log file rotated by lumberjack when it reaches its
+// maximum size and optionally after an interval
+type rotatingFile struct {
+	*lumberjack.Logger
+	stop chan struct{}
+}
+
+// openOutput opens stdout, stderr, a syslog server or the log file at the
+// path
+func (c loggingConfig) openOutput(output string) (io.WriteCloser, error) {
+	switch {
+	case output == logOutputStdout || output == "":
+		return nopWriteCloser{os.Stdout}, nil
+	case output == logOutputStderr:
+		return nopWriteCloser{os.Stderr}, nil
+	case isSyslogOutput(output):
+		return c.Syslog.openSyslog(output)
+	}
+	r := c.Rotation
+	// lumberjack opens the file on the first write, opening it here
+	// reports missing permissions on start and keeps the mode of new files
+	f, err := os.OpenFile(output, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open log file: %w", err)
+	}
+	_ = f.Close()
+	file := &rotatingFile{
+		Logger: &lumberjack.Logger{
+			Filename:   output,
+			MaxSize:    r.MaxSize,
+			MaxAge:     int((r.MaxAge + 24*time.Hour - 1) / (24 * time.Hour)),
+			MaxBackups: r.MaxBackups,
+			Compress:   r.Compress,
+			LocalTime:  true,
+		},
+		stop: make(chan struct{}),
+	}
+	if r.Interval > 0 {
+		go file.rotateEvery(r.Interval)
+	}
+	return file, nil
+}
+
+func (f *rotatingFile) rotateEvery(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := f.Rotate(); err != nil {
+				log.Errorf("could not rotate log file %s: %v", f.Filename, err)
+			}
+		case <-f.stop:
+			return
+		}
+	}
+}
+
+func (f *rotatingFile) Close() error {
+	close(f.stop)
+	return f.Logger.Close()
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
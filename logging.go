@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+	// mainComponent is the component of log entries of the logger log
+	mainComponent = "main"
+)
+
+// logFields are further fields of a log entry
+type logFields map[string]any
+
+// logger writes the application log of a component to the log/slog handler
+// of the logging config, keeping the printf style of the call sites. The
+// level of every component can be set on its own.
+type logger struct {
+	component string
+	attrs     []slog.Attr
+}
+
+// log is the logger of everything not belonging to a component
+var log = &logger{component: mainComponent}
+
+// the loggers of the components, their level is set in logging.levels
+var (
+	reloadLog  = componentLogger("reload")
+	storeLog   = componentLogger("store")
+	tlsLog     = componentLogger("tls")
+	kvLog      = componentLogger("kv")
+	gitLog     = componentLogger("git")
+	upgradeLog = componentLogger("upgrade")
+)
+
+// componentLogger returns the logger of a component like store or tls
+func componentLogger(component string) *logger {
+	return &logger{component: component}
+}
+
+// logSetup is the active handler and levels, replaced as a whole when the
+// logging config changes
+type logSetup struct {
+	out     io.Writer
+	format  string
+	handler slog.Handler
+	level   slog.Level
+	levels  map[string]slog.Level
+}
+
+var activeLog atomic.Pointer[logSetup]
+
+func init() {
+	activeLog.Store(newLogSetup(os.Stderr, logFormatText, slog.LevelInfo, nil))
+}
+
+func newLogSetup(out io.Writer, format string, level slog.Level, levels map[string]slog.Level) *logSetup {
+	return &logSetup{out: out, format: format, handler: newLogHandler(out, format), level: level, levels: levels}
+}
+
+func newLogHandler(out io.Writer, format string) slog.Handler {
+	// the levels are checked by the logger, the handler writes everything
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	if format == logFormatJSON {
+		return slog.NewJSONHandler(out, opts)
+	}
+	return slog.NewTextHandler(out, opts)
+}
+
+// setLogOutput writes the application log to w
+func setLogOutput(w io.Writer) {
+	s := activeLog.Load()
+	activeLog.Store(newLogSetup(w, s.format, s.level, s.levels))
+}
+
+// configureLogging applies the format and levels of the logging config
+func configureLogging(c loggingConfig) {
+	level, levels, _ := c.parseLevels()
+	s := activeLog.Load()
+	activeLog.Store(newLogSetup(s.out, c.Format, level, levels))
+}
+
+// parseLevel parses debug, info, warn or error
+func parseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return level, fmt.Errorf("invalid log level %q, expected debug, info, warn or error", s)
+	}
+	return level, nil
+}
+
+// parseLevels returns the default level and the levels of the components,
+// Debug lowers the default level to debug
+func (c loggingConfig) parseLevels() (slog.Level, map[string]slog.Level, error) {
+	level, err := parseLevel(c.Level)
+	if err != nil {
+		return level, nil, err
+	}
+	if c.Debug {
+		level = slog.LevelDebug
+	}
+	levels := make(map[string]slog.Level, len(c.Levels))
+	for component, s := range c.Levels {
+		l, err := parseLevel(s)
+		if err != nil {
+			return level, nil, fmt.Errorf("component %s: %w", component, err)
+		}
+		levels[component] = l
+	}
+	return level, levels, nil
+}
+
+func (c loggingConfig) validate() error {
+	if c.Format != logFormatText && c.Format != logFormatJSON {
+		return fmt.Errorf("invalid log format %q", c.Format)
+	}
+	if c.Output == "" {
+		return fmt.Errorf("the log output must be stdout, stderr, syslog or a file")
+	}
+	if err := c.Rotation.validate(); err != nil {
+		return err
+	}
+	if err := c.Syslog.validate(); err != nil {
+		return err
+	}
+	if err := validateAnonymize(c.AnonymizeIP); err != nil {
+		return err
+	}
+	if c.Sample < 0 {
+		return fmt.Errorf("the access log sample must not be negative")
+	}
+	for _, pattern := range c.ExcludePaths {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid access log exclude pattern %q: %w", pattern, err)
+		}
+	}
+	_, _, err := c.parseLevels()
+	return err
+}
+
+// enabled reports if entries of the level are written
+func (l *logger) enabled(s *logSetup, level slog.Level) bool {
+	min, ok := s.levels[l.component]
+	if !ok {
+		min = s.level
+	}
+	return level >= min
+}
+
+func (l *logger) write(level slog.Level, msg string) {
+	s := activeLog.Load()
+	r := slog.NewRecord(time.Now(), level, msg, 0)
+	if l.component != mainComponent {
+		r.AddAttrs(slog.String("component", l.component))
+	}
+	r.AddAttrs(l.attrs...)
+	// syslog gets the entry with its level as severity
+	if lw, ok := s.out.(levelWriter); ok {
+		var buf bytes.Buffer
+		_ = newLogHandler(&buf, s.format).Handle(context.Background(), r)
+		_ = lw.writeLevel(level, buf.Bytes())
+		return
+	}
+	_ = s.handler.Handle(context.Background(), r)
+}
+
+func (l *logger) print(level slog.Level, args []any) {
+	if l.enabled(activeLog.Load(), level) {
+		l.write(level, fmt.Sprint(args...))
+	}
+}
+
+func (l *logger) printf(level slog.Level, format string, args []any) {
+	if l.enabled(activeLog.Load(), level) {
+		l.write(level, fmt.Sprintf(format, args...))
+	}
+}
+
+// WithFields returns a logger adding the fields to its entries
+func (l *logger) WithFields(fields logFields) *logger {
+	attrs := slices.Clone(l.attrs)
+	for _, key := range slices.Sorted(maps.Keys(fields)) {
+		attrs = append(attrs, slog.Any(key, fields[key]))
+	}
+	return &logger{component: l.component, attrs: attrs}
+}
+
+func (l *logger) Debug(args ...any)                 { l.print(slog.LevelDebug, args) }
+func (l *logger) Debugf(format string, args ...any) { l.printf(slog.LevelDebug, format, args) }
+func (l *logger) Info(args ...any)                  { l.print(slog.LevelInfo, args) }
+func (l *logger) Infof(format string, args ...any)  { l.printf(slog.LevelInfo, format, args) }
+func (l *logger) Warn(args ...any)                  { l.print(slog.LevelWarn, args) }
+func (l *logger) Warnf(format string, args ...any)  { l.printf(slog.LevelWarn, format, args) }
+func (l *logger) Error(args ...any)                 { l.print(slog.LevelError, args) }
+func (l *logger) Errorf(format string, args ...any) { l.printf(slog.LevelError, format, args) }
+
+// Fatal and Fatalf log the error and exit the process
+func (l *logger) Fatal(args ...any) {
+	l.write(slog.LevelError, fmt.Sprint(args...))
+	os.Exit(1)
+}
+
+func (l *logger) Fatalf(format string, args ...any) {
+	l.write(slog.LevelError, fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
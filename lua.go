@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+const (
+	luaFunction = "redirect"
+	luaTimeout  = time.Second
+)
+
+// luaHook calls the redirect function of a Lua script for every request.
+// The function receives a table describing the request and returns the
+// target and optionally a status code. Returning nil hands the request over
+// to the rules. Lua states are not safe for concurrent use so every request
+// borrows one from a pool.
+type luaHook struct {
+	proto *lua.FunctionProto
+	pool  sync.Pool
+}
+
+func loadLuaHook(filename string) (*luaHook, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not read lua script: %w", err)
+	}
+	chunk, err := parse.Parse(strings.NewReader(string(content)), filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse lua script: %w", err)
+	}
+	proto, err := lua.Compile(chunk, filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not compile lua script: %w", err)
+	}
+	h := &luaHook{proto: proto}
+	// make sure the script runs and defines the function before serving
+	L, err := h.newState()
+	if err != nil {
+		return nil, err
+	}
+	h.pool.Put(L)
+	return h, nil
+}
+
+func (h *luaHook) newState() (*lua.LState, error) {
+	L := lua.NewState()
+	L.Push(L.NewFunctionFromProto(h.proto))
+	if err := L.PCall(0, lua.MultRet, nil); err != nil {
+		L.Close()
+		return nil, fmt.Errorf("could not run lua script: %w", err)
+	}
+	if L.GetGlobal(luaFunction).Type() != lua.LTFunction {
+		L.Close()
+		return nil, fmt.Errorf("lua script does not define a %s function", luaFunction)
+	}
+	return L, nil
+}
+
+func (h *luaHook) requestTable(L *lua.LState, r *http.Request) *lua.LTable {
+	headers := L.NewTable()
+	for name, values := range r.Header {
+		headers.RawSetString(strings.ToLower(name), lua.LString(strings.Join(values, ", ")))
+	}
+	t := L.NewTable()
+	t.RawSetString("path", lua.LString(r.URL.Path))
+	t.RawSetString("query", lua.LString(r.URL.RawQuery))
+	t.RawSetString("host", lua.LString(requestHost(r)))
+	t.RawSetString("method", lua.LString(r.Method))
+	t.RawSetString("scheme", lua.LString(requestScheme(r)))
+	t.RawSetString("client_ip", lua.LString(clientIP(r)))
+	t.RawSetString("user_agent", lua.LString(r.UserAgent()))
+	t.RawSetString("headers", headers)
+	return t
+}
+
+// decide calls the script for the request. ok is false if the script
+// returned nil.
+func (h *luaHook) decide(r *http.Request) (target string, status int, ok bool, err error) {
+	L, _ := h.pool.Get().(*lua.LState)
+	if L == nil {
+		if L, err = h.newState(); err != nil {
+			return "", 0, false, err
+		}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), luaTimeout)
+	defer cancel()
+	L.SetContext(ctx)
+
+	err = L.CallByParam(lua.P{
+		Fn:      L.GetGlobal(luaFunction),
+		NRet:    2,
+		Protect: true,
+	}, h.requestTable(L, r))
+	if err != nil {
+		// the state might be left in an undefined state, do not reuse it
+		L.Close()
+		return "", 0, false, fmt.Errorf("lua hook failed: %w", err)
+	}
+	retTarget, retStatus := L.Get(-2), L.Get(-1)
+	L.Pop(2)
+	L.RemoveContext()
+	h.pool.Put(L)
+
+	if retTarget == lua.LNil {
+		return "", 0, false, nil
+	}
+	str, isString := retTarget.(lua.LString)
+	if !isString {
+		return "", 0, false, fmt.Errorf("lua hook returned a %s instead of a target string", retTarget.Type())
+	}
+	target = string(str)
+	if target == "" {
+		return "", 0, false, fmt.Errorf("lua hook returned an empty target")
+	}
+	if err := validateTarget(target); err != nil {
+		return "", 0, false, fmt.Errorf("lua hook returned an %w", err)
+	}
+	if n, isNumber := retStatus.(lua.LNumber); isNumber {
+		status = int(n)
+	}
+	if status != 0 && !validRedirectStatus(status) {
+		return "", 0, false, fmt.Errorf("lua hook returned invalid status code %d", status)
+	}
+	return target, status, true, nil
+}
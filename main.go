@@ -2,109 +2,315 @@ package main
 
 import (
 	"context"
-	"flag"
-	"fmt"
+	"crypto/tls"
+	"errors"
+	"io"
 	"net/http"
 	"os"
 	"os/signal"
-	"runtime/debug"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/gorilla/handlers"
-	"github.com/gorilla/mux"
-	log "github.com/sirupsen/logrus"
+	"github.com/DataDog/datadog-go/v5/statsd"
+	"github.com/quic-go/quic-go/http3"
 )
 
-const (
-	defaultGracefulTimeout = 5 * time.Second
-)
+type application struct {
+	cfg         atomic.Pointer[config]
+	router      atomic.Pointer[http.Handler]
+	reloadMu    sync.Mutex
+	maintenance atomic.Bool
+	// ready is set once all listeners are started until the shutdown
+	ready atomic.Bool
+	// started, openConnections and reloads are reported by the stats of
+	// the admin listener
+	started         time.Time
+	openConnections atomic.Int64
+	reloads         reloadStats
 
-var (
-	debugOutput bool
-	redirect    string
-)
+	// background is canceled on shutdown to stop the watchers
+	background   context.Context
+	kvWatchersMu sync.Mutex
+	kvWatchers   map[string]bool
+	// storeMu serializes changes of stored rules and their reload
+	storeMu sync.Mutex
+	// retired are replaced configs waiting to be closed
+	retiredMu sync.Mutex
+	retired   map[*config]bool
+	// certificates are served by the listeners using certificate files,
+	// by the name of the listener
+	certificates atomic.Pointer[map[string][]tls.Certificate]
+	// handoff hands the connections over to the new process of upgrades
+	handoff handoff
+	// connections limits the concurrent connections of all listeners,
+	// clientConnections those of each client address
+	connections       connLimiter
+	clientConnections *ipConnLimiter
+	// statsd sends request metrics to a StatsD agent, nil if disabled
+	statsd statsd.ClientInterface
+	// tracing creates spans of requests exported to an OTLP collector
+	tracing bool
+	// accessLog is the destination of the access log, accessSamples counts
+	// the requests sampled by logging.sample
+	accessLog     io.Writer
+	accessSamples atomic.Uint64
+}
+
+// redirectHook decides the target of a request before the rules are
+// evaluated. ok is false if the hook leaves the request to the rules, a
+// status of 0 uses the configured status code.
+type redirectHook interface {
+	decide(r *http.Request) (target string, status int, ok bool, err error)
+}
+
+// config returns the active configuration
+func (app *application) config() *config {
+	return app.cfg.Load()
+}
 
-type application struct{}
+// setConfig activates the configuration for new requests
+func (app *application) setConfig(cfg *config) {
+	app.cfg.Store(cfg)
+	setRuleMetrics(cfg.Rules)
+	router := app.newRouter(cfg)
+	app.router.Store(&router)
+}
 
 func main() {
-	var host string
-	var wait time.Duration
-	flag.StringVar(&host, "host", "0.0.0.0:8080", "IP and Port to bind to")
-	flag.StringVar(&redirect, "redirect", "https://google.com", "redirect target")
-	flag.BoolVar(&debugOutput, "debug", false, "Enable DEBUG mode")
-	flag.DurationVar(&wait, "graceful-timeout", defaultGracefulTimeout, "the duration for which the server gracefully wait for existing connections to finish - e.g. 15s or 1m")
-	flag.Parse()
-
-	log.SetOutput(os.Stdout)
-	if debugOutput {
-		log.SetLevel(log.DebugLevel)
-	} else {
-		log.SetLevel(log.InfoLevel)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "validate":
+			setLogOutput(os.Stdout)
+			os.Exit(validate(os.Args[2:]))
+		case "import":
+			setLogOutput(os.Stdout)
+			os.Exit(importCommand(os.Args[2:]))
+		case "export":
+			// stdout is reserved for the rules
+			os.Exit(exportCommand(os.Args[2:]))
+		}
+	}
+
+	cfg, err := parseConfig(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	app := &application{}
+	logOutput, err := cfg.Logging.openOutput(cfg.Logging.Output)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer logOutput.Close()
+	accessOutput := logOutput
+	if o := cfg.Logging.AccessOutput; o != "" && o != cfg.Logging.Output {
+		if accessOutput, err = cfg.Logging.openOutput(o); err != nil {
+			log.Fatal(err)
+		}
+		defer accessOutput.Close()
+	}
+	setLogOutput(logOutput)
+	configureLogging(cfg.Logging)
+
+	if cfg.file != "" {
+		log.Infof("Loaded config from %s", cfg.file)
+	}
+	if cfg.Git.Repository != "" {
+		if _, err := cfg.Git.sync(context.Background()); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := cfg.prepare(); err != nil {
+		log.Fatal(err)
+	}
+	backgroundCtx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	app := &application{
+		started:           time.Now(),
+		accessLog:         accessOutput,
+		background:        backgroundCtx,
+		connections:       newConnLimiter(cfg.Limits.MaxConnections),
+		clientConnections: newIPConnLimiter(cfg.Limits.MaxConnectionsPerIP),
+	}
+	defer app.closeConfigs()
+	if app.statsd, err = cfg.StatsD.newStatsd(); err != nil {
+		log.Fatalf("could not create statsd client: %v", err)
+	}
+	if app.statsd != nil {
+		defer app.statsd.Close()
+	}
+	stopTracing, err := cfg.OTLP.startTracing()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if stopTracing != nil {
+		app.tracing = true
+		defer flushTelemetry(stopTracing, cfg.Timeouts.Graceful, "traces")
+	}
+	stopMetrics, err := cfg.OTLP.startMetrics()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if stopMetrics != nil {
+		defer flushTelemetry(stopMetrics, cfg.Timeouts.Graceful, "metrics")
+	}
+
+	app.setConfig(cfg)
+	app.setMaintenance(cfg.Maintenance.Enabled)
+	go app.toggleMaintenanceOnSignal()
+	go app.reloadOnSignal()
+	upgraded := make(chan struct{})
+	go app.upgradeOnSignal(upgraded)
 
 	srv := &http.Server{
-		Addr:    host,
-		Handler: app.routes(),
+		Addr:      cfg.Listen.Address,
+		Handler:   app.routes(),
+		Protocols: serverProtocols(cfg),
 	}
-	log.Infof("Starting server on %s", host)
-	if debugOutput {
+	cfg.configureServer(srv)
+	app.storeCertificates(cfg.certificates)
+	if cfg.TLS.enabled() {
+		srv.TLSConfig = app.serverTLSConfig(cfg)
+	}
+	if len(cfg.certificates) > 0 {
+		go func() {
+			if err := app.watchCertificate(backgroundCtx); err != nil {
+				log.Errorf("could not watch certificates: %v", err)
+			}
+		}()
+	}
+	if srv.TLSConfig != nil {
+		log.Infof("Starting server on %s with TLS", cfg.Listen.Address)
+	} else {
+		log.Infof("Starting server on %s", cfg.Listen.Address)
+	}
+	if cfg.Logging.Debug {
 		log.Debug("DEBUG mode enabled")
 	}
 
-	go func() {
-		if err := srv.ListenAndServe(); err != nil {
-			log.Error(err)
+	var h3Srv *http3.Server
+	if cfg.Listen.HTTP3 {
+		h3Srv = newHTTP3Server(srv)
+		srv.Handler = advertiseHTTP3(h3Srv, srv.Handler)
+		log.Infof("Starting HTTP/3 server on %s (udp)", cfg.Listen.Address)
+		conn, err := listenPacket(cfg.Listen.Address)
+		if err != nil {
+			log.Fatalf("could not listen on %s (udp): %v", cfg.Listen.Address, err)
 		}
-	}()
+		go func() {
+			if err := h3Srv.Serve(conn); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Error(err)
+			}
+		}()
+	}
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
-	<-c
-	ctx, cancel := context.WithTimeout(context.Background(), wait)
-	defer cancel()
-	log.Info("shutting down")
-	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatal(err)
+	public := serveOptions{proxyProtocol: cfg.Listen.ProxyProtocol, limited: true}
+	app.serve(srv, public)
+
+	go app.watchExpiredRules(backgroundCtx)
+	app.startKVWatchers()
+
+	if cfg.Git.Repository != "" && cfg.Git.Interval > 0 {
+		go app.pollGit(backgroundCtx, cfg.Git)
+	}
+	if cfg.PollInterval > 0 {
+		go app.pollRemote(backgroundCtx, cfg.PollInterval)
+	}
+	if cfg.WatchConfig {
+		go func() {
+			if err := app.watchConfig(backgroundCtx); err != nil {
+				log.Errorf("could not watch config: %v", err)
+			}
+		}()
 	}
-	os.Exit(0)
-}
 
-func (app *application) routes() http.Handler {
-	r := mux.NewRouter()
-	r.Use(app.loggingMiddleware)
-	r.Use(app.recoverPanic)
-	r.PathPrefix("/").HandlerFunc(app.catchAllHandler)
-	return r
-}
+	if cfg.acmeDNS != nil {
+		go cfg.acmeDNS.run(backgroundCtx)
+	}
+	var acmeSrv *http.Server
+	if cfg.acme != nil && cfg.TLS.ACME.HTTP != "" {
+		acmeSrv = &http.Server{
+			Addr:    cfg.TLS.ACME.HTTP,
+			Handler: cfg.acme.HTTPHandler(app.routes()),
+		}
+		cfg.configureServer(acmeSrv)
+		log.Infof("Starting acme challenge server on %s", cfg.TLS.ACME.HTTP)
+		app.serve(acmeSrv, public)
+	}
 
-func (app *application) catchAllHandler(w http.ResponseWriter, r *http.Request) {
-	http.Redirect(w, r, redirect, http.StatusMovedPermanently)
-}
+	var redirectSrv *http.Server
+	if cfg.Listen.HTTPSRedirect != "" {
+		handler := app.requestID(app.trace(app.instrument(app.limitClients(app.realIP(app.loggingMiddleware(app.limitBody(app.healthCheck(httpsRedirect(cfg.Listen.Address)))))))))
+		if cfg.acme != nil {
+			handler = cfg.acme.HTTPHandler(handler)
+		}
+		redirectSrv = &http.Server{
+			Addr:    cfg.Listen.HTTPSRedirect,
+			Handler: handler,
+		}
+		cfg.configureServer(redirectSrv)
+		log.Infof("Starting https redirect server on %s", cfg.Listen.HTTPSRedirect)
+		app.serve(redirectSrv, public)
+	}
 
-func (app *application) loggingMiddleware(next http.Handler) http.Handler {
-	return handlers.CombinedLoggingHandler(os.Stdout, next)
-}
+	listeners := app.startListeners(cfg)
 
-func (app *application) logError(w http.ResponseWriter, err error, withTrace bool) {
-	w.Header().Set("Connection", "close")
-	errorText := fmt.Sprintf("%v", err)
-	log.Error(errorText)
-	if withTrace {
-		log.Errorf("%s", debug.Stack())
+	var adminSrv *http.Server
+	if cfg.Listen.Admin != "" {
+		adminSrv = &http.Server{
+			Addr:    cfg.Listen.Admin,
+			Handler: app.adminRoutes(),
+		}
+		cfg.configureServer(adminSrv)
+		if cfg.PProf {
+			// CPU profiles and traces are written for 30 seconds by default
+			adminSrv.WriteTimeout = 0
+		}
+		log.Infof("Starting admin server on %s", cfg.Listen.Admin)
+		app.serve(adminSrv, serveOptions{})
 	}
-	http.Error(w, "There was an error processing your request", http.StatusInternalServerError)
-}
 
-func (app *application) recoverPanic(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		defer func() {
-			if err := recover(); err != nil {
-				app.logError(w, fmt.Errorf("%s", err), true)
-			}
-		}()
-		next.ServeHTTP(w, r)
-	})
+	upgradeReady()
+	app.ready.Store(true)
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case <-c:
+	case <-upgraded:
+		app.handoff.handOver(cfg.Timeouts.Graceful)
+	}
+	app.ready.Store(false)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.Graceful)
+	defer cancel()
+	log.Info("shutting down")
+	if adminSrv != nil {
+		if err := adminSrv.Shutdown(ctx); err != nil {
+			log.Error(err)
+		}
+	}
+	if h3Srv != nil {
+		if err := h3Srv.Shutdown(ctx); err != nil {
+			log.Error(err)
+		}
+	}
+	if acmeSrv != nil {
+		if err := acmeSrv.Shutdown(ctx); err != nil {
+			log.Error(err)
+		}
+	}
+	if redirectSrv != nil {
+		if err := redirectSrv.Shutdown(ctx); err != nil {
+			log.Error(err)
+		}
+	}
+	for _, l := range listeners {
+		if err := l.Shutdown(ctx); err != nil {
+			log.Error(err)
+		}
+	}
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Fatal(err)
+	}
 }
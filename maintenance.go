@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+const defaultMaintenancePage = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Maintenance</title></head>
+<body><p>This service is currently down for maintenance. Please try again later.</p></body>
+</html>
+`
+
+// maintenanceMode answers all requests with 503 while maintenance is enabled
+func (app *application) maintenanceMode(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.maintenance.Load() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cfg := app.config()
+		if cfg.Maintenance.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(cfg.Maintenance.RetryAfter.Seconds())))
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write(cfg.maintenancePage)
+	})
+}
+
+// setMaintenance enables or disables the maintenance mode
+func (app *application) setMaintenance(enabled bool) {
+	if app.maintenance.Swap(enabled) != enabled {
+		if enabled {
+			log.Info("maintenance mode enabled")
+		} else {
+			log.Info("maintenance mode disabled")
+		}
+	}
+}
+
+type maintenanceStatus struct {
+	Enabled bool `json:"enabled"`
+}
+
+func (app *application) maintenanceGetHandler(w http.ResponseWriter, _ *http.Request) {
+	app.writeJSON(w, http.StatusOK, maintenanceStatus{Enabled: app.maintenance.Load()})
+}
+
+func (app *application) maintenanceSetHandler(w http.ResponseWriter, r *http.Request) {
+	enabled, err := strconv.ParseBool(r.FormValue("enabled"))
+	if err != nil {
+		http.Error(w, "enabled must be true or false", http.StatusBadRequest)
+		return
+	}
+	app.setMaintenance(enabled)
+	app.writeJSON(w, http.StatusOK, maintenanceStatus{Enabled: enabled})
+}
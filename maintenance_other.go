@@ -0,0 +1,7 @@
+//go:build !unix
+
+package main
+
+// toggleMaintenanceOnSignal does nothing as there is no SIGUSR1, the
+// maintenance mode is switched through the admin listener
+func (app *application) toggleMaintenanceOnSignal() {}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// toggleMaintenanceOnSignal switches the maintenance mode on every SIGUSR1
+func (app *application) toggleMaintenanceOnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+	for range c {
+		app.setMaintenance(!app.maintenance.Load())
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/felixge/httpsnoop"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// metricsNamespace prefixes the names of all metrics
+const metricsNamespace = "redirector"
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_requests_total",
+		Help:      "Requests by listener, status code and method.",
+	}, []string{"listener", "code", "method"})
+	requestsInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_requests_in_flight",
+		Help:      "Requests currently being handled.",
+	})
+	redirectsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "redirects_total",
+		Help:      "Requests sent to a target by listener and action.",
+	}, []string{"listener", "action"})
+	// redirects are answered within a millisecond, slower requests wait
+	// for GeoIP lookups, hooks or storage backends
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time to handle requests by listener and status class.",
+		Buckets:   []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5},
+	}, []string{"listener", "class"})
+	ruleRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rule_requests_total",
+		Help:      "Requests matching a rule by rule and configured target.",
+	}, []string{"rule", "target"})
+)
+
+// ruleSeries are the label values of the rules of the active config, rules
+// are reported with 0 requests until they match
+var ruleSeries = struct {
+	sync.Mutex
+	labels map[[2]string]bool
+}{}
+
+// instrument counts the requests of the public listeners by status code
+// and records their duration in the metrics and StatsD, the https redirect
+// listener counts for the main listener
+func (app *application) instrument(next http.Handler) http.Handler {
+	listener := promhttp.WithLabelFromCtx("listener", listenerFromContext)
+	timed := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := httpsnoop.CaptureMetrics(next, w, r)
+		requestDuration.WithLabelValues(listenerName(r), statusClass(m.Code)).Observe(m.Duration.Seconds())
+		app.sendRequestMetrics(r, m.Code, m.Duration)
+	})
+	return promhttp.InstrumentHandlerInFlight(requestsInFlight,
+		promhttp.InstrumentHandlerCounter(requestsTotal, timed, listener))
+}
+
+// statusClass returns the class of a status code like 3xx
+func statusClass(code int) string {
+	return strconv.Itoa(code/100) + "xx"
+}
+
+// countRedirect counts a request sent to its target with the action
+func countRedirect(r *http.Request, action string) {
+	if action == actionRedirect {
+		action = "redirect"
+	}
+	redirectsTotal.WithLabelValues(listenerName(r), action).Inc()
+	if c := otlpCounters; c != nil {
+		c.redirects.Add(r.Context(), 1, metric.WithAttributes(
+			attribute.String("listener", listenerName(r)), attribute.String("action", action)))
+	}
+}
+
+// ruleLabels returns the label values of the rule
+func ruleLabels(ru *rule) [2]string {
+	return [2]string{ru.key(), ru.Target}
+}
+
+// countRule counts a request matching the rule
+func countRule(r *http.Request, ru *rule) {
+	l := ruleLabels(ru)
+	ruleRequestsTotal.WithLabelValues(l[0], l[1]).Inc()
+	if c := otlpCounters; c != nil {
+		c.ruleRequests.Add(r.Context(), 1, metric.WithAttributes(
+			attribute.String("rule", l[0]), attribute.String("target", l[1])))
+	}
+}
+
+// setRuleMetrics adds the rules of the config to the metrics and removes
+// those of rules no longer configured
+func setRuleMetrics(rules []rule) {
+	ruleSeries.Lock()
+	defer ruleSeries.Unlock()
+	labels := make(map[[2]string]bool, len(rules))
+	for i := range rules {
+		l := ruleLabels(&rules[i])
+		labels[l] = true
+		ruleRequestsTotal.WithLabelValues(l[0], l[1])
+	}
+	for l := range ruleSeries.labels {
+		if !labels[l] {
+			ruleRequestsTotal.DeleteLabelValues(l[0], l[1])
+		}
+	}
+	ruleSeries.labels = labels
+}
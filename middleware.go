@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/felixge/httpsnoop"
+	"github.com/gorilla/handlers"
+)
+
+// accessLogEntry is a line of the JSON access log
+type accessLogEntry struct {
+	Time      time.Time `json:"time"`
+	Listener  string    `json:"listener"`
+	ClientIP  string    `json:"client_ip"`
+	User      string    `json:"user,omitempty"`
+	Method    string    `json:"method"`
+	Host      string    `json:"host"`
+	Path      string    `json:"path"`
+	Query     string    `json:"query,omitempty"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Target    string    `json:"target,omitempty"`
+	Referer   string    `json:"referer,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	LatencyMS float64   `json:"latency_ms"`
+	// uri is the path and query as requested and anonymize the mode of
+	// the addresses of forwarding headers for access log templates
+	uri       string
+	anonymize string
+}
+
+func (app *application) loggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := app.config()
+		if cfg.excludedFromAccessLog(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if cfg.Logging.AccessFormat == accessFormatJSON || cfg.accessTemplate != nil {
+			app.logEntry(cfg, next, w, r)
+			return
+		}
+		// the subject of a client certificate is logged as user with escaped
+		// spaces, the handlers get the request without it and with the
+		// address of the client if it is anonymized in the log
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			subject := r.TLS.PeerCertificates[0].Subject.String()
+			r.URL.User = url.User(strings.ReplaceAll(subject, " ", "%20"))
+		}
+		logged := r
+		if mode := cfg.Logging.AnonymizeIP; mode != "" {
+			// realIP sets the address of clients behind proxies without port
+			logged = r.WithContext(r.Context())
+			logged.RemoteAddr = anonymizeIP(mode, clientIP(r))
+			if _, port, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+				logged.RemoteAddr = net.JoinHostPort(logged.RemoteAddr, port)
+			}
+		}
+		handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			r.URL.User = nil
+			next.ServeHTTP(w, r)
+		})
+		var out io.Writer = app.accessLog
+		if n := cfg.Logging.Sample; n > 1 {
+			// the line is written after the response, the status decides
+			// if it is kept
+			s := &sampledLog{out: app.accessLog, keep: func(status int) bool { return app.sampleAccessLog(n, status) }}
+			out, w = s, recordStatus(w, &s.status)
+		}
+		handlers.CombinedLoggingHandler(out, handler).ServeHTTP(w, logged)
+	})
+}
+
+// excludedFromAccessLog reports if the path or client of the request is
+// excluded from the access log, like health checks of internal monitors
+func (cfg *config) excludedFromAccessLog(r *http.Request) bool {
+	for _, pattern := range cfg.Logging.ExcludePaths {
+		if ok, _ := path.Match(pattern, r.URL.Path); ok {
+			return true
+		}
+	}
+	if len(cfg.accessExcluded) > 0 {
+		return containsIP(cfg.accessExcluded, net.ParseIP(clientIP(r)))
+	}
+	return false
+}
+
+// sampleAccessLog reports if a request is written to the sampled access
+// log, all requests answered with an error or blocked and every nth of the
+// others are
+func (app *application) sampleAccessLog(n, status int) bool {
+	return status >= http.StatusBadRequest || app.accessSamples.Add(1)%uint64(n) == 0
+}
+
+// sampledLog writes the access log line of a request only if it is kept
+type sampledLog struct {
+	out    io.Writer
+	status int
+	keep   func(status int) bool
+}
+
+func (s *sampledLog) Write(p []byte) (int, error) {
+	if !s.keep(s.status) {
+		return len(p), nil
+	}
+	return s.out.Write(p)
+}
+
+// recordStatus stores the status code of the response in status
+func recordStatus(w http.ResponseWriter, status *int) http.ResponseWriter {
+	return httpsnoop.Wrap(w, httpsnoop.Hooks{
+		WriteHeader: func(next httpsnoop.WriteHeaderFunc) httpsnoop.WriteHeaderFunc {
+			return func(code int) {
+				if *status == 0 {
+					*status = code
+				}
+				next(code)
+			}
+		},
+		Write: func(next httpsnoop.WriteFunc) httpsnoop.WriteFunc {
+			return func(b []byte) (int, error) {
+				if *status == 0 {
+					*status = http.StatusOK
+				}
+				return next(b)
+			}
+		},
+	})
+}
+
+// logEntry writes a JSON object or the line of the template of the request
+// to the access log after it is handled, the target is the Location of
+// redirects
+func (app *application) logEntry(cfg *config, next http.Handler, w http.ResponseWriter, r *http.Request) {
+	entry := accessLogEntry{
+		Time:      time.Now(),
+		Listener:  listenerName(r),
+		ClientIP:  anonymizeIP(cfg.Logging.AnonymizeIP, clientIP(r)),
+		Method:    r.Method,
+		Host:      r.Host,
+		Path:      r.URL.Path,
+		Query:     r.URL.RawQuery,
+		Proto:     r.Proto,
+		Referer:   r.Referer(),
+		UserAgent: r.UserAgent(),
+		RequestID: requestIDFromContext(r.Context()),
+		uri:       r.RequestURI,
+		anonymize: cfg.Logging.AnonymizeIP,
+	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		entry.User = r.TLS.PeerCertificates[0].Subject.String()
+	}
+	m := httpsnoop.CaptureMetrics(next, w, r)
+	entry.Status, entry.Bytes = m.Code, m.Written
+	entry.Target = w.Header().Get("Location")
+	entry.LatencyMS = float64(m.Duration.Microseconds()) / 1000
+	if n := cfg.Logging.Sample; n > 1 && !app.sampleAccessLog(n, entry.Status) {
+		return
+	}
+	if cfg.accessTemplate != nil {
+		_, _ = app.accessLog.Write(cfg.accessTemplate.format(&entry, r))
+		return
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Errorf("could not write access log: %v", err)
+		return
+	}
+	_, _ = app.accessLog.Write(append(line, '\n'))
+}
+
+// addResponseHeaders adds the globally configured headers to every response
+func (app *application) addResponseHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, value := range app.config().Headers {
+			w.Header().Set(name, value)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// methodFilter rejects requests using a method that is not allowed
+func (app *application) methodFilter(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods := app.config().Methods
+		if len(methods) > 0 && !slices.Contains(methods, r.Method) {
+			w.Header().Set("Allow", strings.Join(methods, ", "))
+			app.errorPage(w, r, http.StatusMethodNotAllowed)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// canonicalizeHost redirects to the same URL on the www or apex host,
+// keeping path and query intact
+func (app *application) canonicalizeHost(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := app.config()
+		host := requestHost(r)
+		canonical := host
+		switch cfg.CanonicalHost {
+		case canonicalHostStripWWW:
+			canonical = strings.TrimPrefix(host, "www.")
+		case canonicalHostAddWWW:
+			if strings.Contains(host, ".") && !strings.HasPrefix(host, "www.") && net.ParseIP(host) == nil {
+				canonical = "www." + host
+			}
+		}
+		if canonical == host {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if _, port, err := net.SplitHostPort(r.Host); err == nil {
+			canonical = net.JoinHostPort(canonical, port)
+		}
+		u := url.URL{
+			Scheme:   requestScheme(r),
+			Host:     canonical,
+			Path:     r.URL.Path,
+			RawPath:  r.URL.RawPath,
+			RawQuery: r.URL.RawQuery,
+		}
+		app.redirect(w, r, u.String(), cfg.Status)
+	})
+}
+
+// canonicalSlash redirects to the canonical form of the path when trailing
+// slashes should be stripped or added
+func (app *application) canonicalSlash(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := app.config()
+		p := r.URL.Path
+		canonical := p
+		switch cfg.TrailingSlash {
+		case trailingSlashStrip:
+			if p != "/" {
+				canonical = strings.TrimSuffix(p, "/")
+			}
+		case trailingSlashAdd:
+			// do not add slashes to file names like /favicon.ico
+			if !strings.HasSuffix(p, "/") && !strings.Contains(path.Base(p), ".") {
+				canonical = p + "/"
+			}
+		}
+		if canonical == p {
+			next.ServeHTTP(w, r)
+			return
+		}
+		u := *r.URL
+		u.Path = canonical
+		u.RawPath = ""
+		app.redirect(w, r, u.RequestURI(), cfg.Status)
+	})
+}
+
+func (app *application) logError(w http.ResponseWriter, r *http.Request, err error, withTrace bool) {
+	w.Header().Set("Connection", "close")
+	errorText := fmt.Sprintf("%v", err)
+	l := requestLog(r)
+	l.Error(errorText)
+	if withTrace {
+		l.Errorf("%s", debug.Stack())
+	}
+	if _, ok := app.config().errorPages[http.StatusInternalServerError]; ok {
+		app.errorPage(w, r, http.StatusInternalServerError)
+		return
+	}
+	http.Error(w, "There was an error processing your request", http.StatusInternalServerError)
+}
+
+func (app *application) recoverPanic(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				app.logError(w, r, fmt.Errorf("%s", err), true)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const gcsReadScope = "https://www.googleapis.com/auth/devstorage.read_only"
+
+// awsConfig loads the default AWS credential chain once, e.g. environment
+// variables, shared config files or the instance role
+var awsConfig = sync.OnceValues(func() (aws.Config, error) {
+	return awsconfig.LoadDefaultConfig(context.Background())
+})
+
+// gcsTokens returns tokens of the application default credentials
+var gcsTokens = sync.OnceValues(func() (oauth2.TokenSource, error) {
+	return google.DefaultTokenSource(context.Background(), gcsReadScope)
+})
+
+// newObjectRequest builds the GET request for an object in S3 or GCS, so it
+// is fetched and cached like any other remote file.
+// Objects in S3 are fetched with a presigned URL. s3://bucket/key accepts
+// the parameters region and path_style=true, e.g. for MinIO with
+// AWS_ENDPOINT_URL_S3.
+// Objects in GCS are fetched with a token of the application default
+// credentials, or anonymously for public objects if there are none.
+func newObjectRequest(ctx context.Context, u *url.URL) (*http.Request, error) {
+	key := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || key == "" {
+		return nil, fmt.Errorf("object URL %q must be %s://bucket/key", u, u.Scheme)
+	}
+
+	if u.Scheme == "gs" {
+		target := "https://storage.googleapis.com/" + u.Host + "/" + (&url.URL{Path: key}).EscapedPath()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+		if err != nil {
+			return nil, err
+		}
+		tokens, err := gcsTokens()
+		if err != nil {
+			log.Debugf("no google credentials, fetching %s anonymously: %v", u, err)
+			return req, nil
+		}
+		token, err := tokens.Token()
+		if err != nil {
+			return nil, fmt.Errorf("could not get google token: %w", err)
+		}
+		token.SetAuthHeader(req)
+		return req, nil
+	}
+
+	cfg, err := awsConfig()
+	if err != nil {
+		return nil, fmt.Errorf("could not load aws config: %w", err)
+	}
+	query := u.Query()
+	pathStyle, _ := strconv.ParseBool(query.Get("path_style"))
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if region := query.Get("region"); region != "" {
+			o.Region = region
+		}
+		o.UsePathStyle = pathStyle
+	})
+	presigned, err := s3.NewPresignClient(client).PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(u.Host),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not presign %s: %w", u, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, presigned.Method, presigned.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range presigned.SignedHeader {
+		// the host is part of the URL
+		if !strings.EqualFold(name, "Host") {
+			req.Header[name] = values
+		}
+	}
+	return req, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type otlpConfig struct {
+	// Endpoint is the base URL of the OTLP/HTTP receiver of a collector,
+	// e.g. http://127.0.0.1:4318, disabled if empty
+	Endpoint string `yaml:"endpoint"`
+	// ServiceName identifies the redirector in the traces
+	ServiceName string `yaml:"service_name"`
+	// TraceSampleRatio is the share of requests traced that are not part of
+	// a trace sampled by the caller
+	TraceSampleRatio float64 `yaml:"trace_sample_ratio"`
+	// Metrics pushes the request metrics to the collector every
+	// MetricsInterval
+	Metrics         bool          `yaml:"metrics"`
+	MetricsInterval time.Duration `yaml:"metrics_interval"`
+	// AnonymizeIP truncates or hashes the client addresses of spans
+	AnonymizeIP string `yaml:"anonymize_ip"`
+}
+
+func (c otlpConfig) validate() error {
+	if c.Endpoint == "" {
+		return nil
+	}
+	u, err := url.Parse(c.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid otlp endpoint %q, expected a http(s) URL like http://127.0.0.1:4318", c.Endpoint)
+	}
+	if c.TraceSampleRatio < 0 || c.TraceSampleRatio > 1 {
+		return fmt.Errorf("invalid trace sample ratio %v, expected a value between 0 and 1", c.TraceSampleRatio)
+	}
+	if c.Metrics && c.MetricsInterval <= 0 {
+		return fmt.Errorf("invalid otlp metrics interval %s", c.MetricsInterval)
+	}
+	return validateAnonymize(c.AnonymizeIP)
+}
+
+// signalURL returns the URL of the receiver of a signal like traces
+func (c otlpConfig) signalURL(signal string) string {
+	return strings.TrimSuffix(c.Endpoint, "/") + "/v1/" + signal
+}
+
+// resource describes the redirector in the exported telemetry
+func (c otlpConfig) resource() *resource.Resource {
+	return resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(c.ServiceName))
+}
+
+// startTracing exports the spans of requests to the collector and returns
+// the function flushing them on shutdown, nil if no endpoint is configured.
+// Headers like authentication tokens are set with the standard
+// OTEL_EXPORTER_OTLP_HEADERS variable.
+func (c otlpConfig) startTracing() (func(context.Context) error, error) {
+	if c.Endpoint == "" {
+		return nil, nil
+	}
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(c.signalURL("traces")))
+	if err != nil {
+		return nil, fmt.Errorf("could not create trace exporter: %w", err)
+	}
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(c.resource()),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(c.TraceSampleRatio))),
+	}
+	if c.AnonymizeIP != "" {
+		opts = append(opts, sdktrace.WithSpanProcessor(anonymizingProcessor{mode: c.AnonymizeIP}))
+	}
+	tp := sdktrace.NewTracerProvider(opts...)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return tp.Shutdown, nil
+}
+
+// otlpInstruments count redirects and rule requests for the collector
+type otlpInstruments struct {
+	redirects    metric.Int64Counter
+	ruleRequests metric.Int64Counter
+}
+
+// otlpCounters are nil if OTLP metrics are disabled
+var otlpCounters *otlpInstruments
+
+// startMetrics pushes the metrics of the requests to the collector and
+// returns the function sending the last values on shutdown, nil if
+// disabled. The HTTP metrics follow the OpenTelemetry conventions, e.g.
+// http.server.request.duration.
+func (c otlpConfig) startMetrics() (func(context.Context) error, error) {
+	if c.Endpoint == "" || !c.Metrics {
+		return nil, nil
+	}
+	exporter, err := otlpmetrichttp.New(context.Background(), otlpmetrichttp.WithEndpointURL(c.signalURL("metrics")))
+	if err != nil {
+		return nil, fmt.Errorf("could not create metric exporter: %w", err)
+	}
+	mp := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter, sdkmetric.WithInterval(c.MetricsInterval))),
+		sdkmetric.WithResource(c.resource()),
+	)
+	otel.SetMeterProvider(mp)
+	meter := mp.Meter("github.com/firefart/redirector")
+	counters := &otlpInstruments{}
+	if counters.redirects, err = meter.Int64Counter("redirector.redirects", metric.WithDescription("Requests sent to a target by listener and action.")); err != nil {
+		return nil, err
+	}
+	if counters.ruleRequests, err = meter.Int64Counter("redirector.rule.requests", metric.WithDescription("Requests matching a rule by rule and configured target.")); err != nil {
+		return nil, err
+	}
+	otlpCounters = counters
+	return mp.Shutdown, nil
+}
+
+// trace creates a span for every request continuing the trace of the
+// traceparent header and records the OTLP metrics of the request, if
+// tracing or OTLP metrics are enabled
+func (app *application) trace(next http.Handler) http.Handler {
+	if !app.tracing && otlpCounters == nil {
+		return next
+	}
+	return otelhttp.NewHandler(next, "redirector", otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+		return r.Method
+	}))
+}
+
+// traceRedirect adds the listener, the rule and the target of a redirect
+// to the span of the request. ru is nil for redirects of hooks.
+func traceRedirect(r *http.Request, ru *rule, location string) {
+	span := trace.SpanFromContext(r.Context())
+	if !span.IsRecording() {
+		return
+	}
+	attrs := []attribute.KeyValue{
+		attribute.String("redirector.listener", listenerName(r)),
+		attribute.String("redirector.target", location),
+	}
+	if ru != nil {
+		attrs = append(attrs, attribute.String("redirector.rule", ru.key()))
+	}
+	if id := requestIDFromContext(r.Context()); id != "" {
+		attrs = append(attrs, attribute.String("redirector.request_id", id))
+	}
+	span.SetAttributes(attrs...)
+}
+
+// flushTelemetry exports the pending telemetry on shutdown
+func flushTelemetry(stop func(context.Context) error, timeout time.Duration, what string) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := stop(ctx); err != nil {
+		log.Errorf("could not export %s: %v", what, err)
+	}
+}
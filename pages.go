@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var metaRefreshTemplate = template.Must(template.New("meta-refresh").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="referrer" content="no-referrer">
+<meta http-equiv="refresh" content="0;url={{.}}">
+<title>Redirecting</title>
+</head>
+<body><a href="{{.}}">Continue</a></body>
+</html>
+`))
+
+var javascriptTemplate = template.Must(template.New("javascript").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="referrer" content="no-referrer">
+<title>Redirecting</title>
+<script>location.replace({{.}});</script>
+</head>
+<body><noscript><a href="{{.}}">Continue</a></noscript></body>
+</html>
+`))
+
+// interstitialData is passed to the interstitial template
+type interstitialData struct {
+	Target string
+	Host   string
+	Delay  int
+}
+
+const defaultInterstitialTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.Delay}};url={{.Target}}">
+<title>Redirecting to {{.Host}}</title>
+</head>
+<body>
+<p>You are being redirected to {{.Host}} in {{.Delay}} seconds.</p>
+<p><a href="{{.Target}}">Click here to continue</a></p>
+</body>
+</html>
+`
+
+// loadInterstitialTemplate parses the interstitial template from the file
+// or returns the built in template if no file is given
+func loadInterstitialTemplate(filename string) (*template.Template, error) {
+	if filename == "" {
+		return template.New("interstitial").Parse(defaultInterstitialTemplate)
+	}
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not read interstitial template: %w", err)
+	}
+	tmpl, err := template.New("interstitial").Parse(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse interstitial template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// redirectData is passed to the redirect body template
+type redirectData struct {
+	Target string
+	Status int
+}
+
+func loadRedirectTemplate(filename string) (*template.Template, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not read redirect template: %w", err)
+	}
+	tmpl, err := template.New("redirect").Parse(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse redirect template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// redirect sends a redirect to the location. The body is the configured
+// template, empty or the default body of http.Redirect.
+func (app *application) redirect(w http.ResponseWriter, r *http.Request, location string, status int) {
+	cfg := app.config()
+	switch {
+	case cfg.redirectTemplate != nil:
+		w.Header().Set("Location", location)
+		renderPage(w, r, cfg.redirectTemplate, status, redirectData{Target: location, Status: status})
+	case cfg.EmptyRedirectBody:
+		w.Header().Set("Location", location)
+		w.WriteHeader(status)
+	default:
+		http.Redirect(w, r, location, status)
+	}
+}
+
+// renderPage writes the template with the given data as an HTML page
+func renderPage(w http.ResponseWriter, r *http.Request, tmpl *template.Template, status int, data any) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := tmpl.Execute(w, data); err != nil {
+		requestLog(r).Errorf("could not render %s page: %v", tmpl.Name(), err)
+	}
+}
+
+// errorData is passed to error page templates
+type errorData struct {
+	Status     int
+	StatusText string
+}
+
+// loadErrorPages parses all templates named after a status code like
+// 404.html from the directory
+func loadErrorPages(dir string) (map[int]*template.Template, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.html"))
+	if err != nil {
+		return nil, err
+	}
+	pages := make(map[int]*template.Template)
+	for _, f := range files {
+		status, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(f), ".html"))
+		if err != nil || http.StatusText(status) == "" {
+			continue
+		}
+		content, err := os.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("could not read error page: %w", err)
+		}
+		tmpl, err := template.New(filepath.Base(f)).Parse(string(content))
+		if err != nil {
+			return nil, fmt.Errorf("could not parse error page %s: %w", f, err)
+		}
+		pages[status] = tmpl
+	}
+	return pages, nil
+}
+
+// errorPage answers with the status code using the configured error page or
+// a plain text message if there is none
+func (app *application) errorPage(w http.ResponseWriter, r *http.Request, status int) {
+	tmpl, ok := app.config().errorPages[status]
+	if !ok {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	renderPage(w, r, tmpl, status, errorData{Status: status, StatusText: http.StatusText(status)})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pires/go-proxyproto"
+)
+
+// proxyHeaderTimeout is the time a connection has to send the PROXY header
+const proxyHeaderTimeout = 5 * time.Second
+
+// parseNetworks parses a list of CIDR ranges, single addresses are
+// treated as a range of one address
+func parseNetworks(list []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip address %q", s)
+			}
+			bits := 8 * len(ip)
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %w", s, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// containsIP reports if one of the networks contains the address
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyListener reads the PROXY protocol header (v1 and v2) sent by load
+// balancers like haproxy or AWS NLB in front of the listener, the address
+// in the header becomes the remote address of the requests. Connections
+// without a header are closed. If sources are given only connections from
+// them have to send a header, others are served with their own address.
+func proxyListener(ln net.Listener, sources []*net.IPNet) net.Listener {
+	return &proxyproto.Listener{
+		Listener:          ln,
+		ReadHeaderTimeout: proxyHeaderTimeout,
+		ConnPolicy: func(opts proxyproto.ConnPolicyOptions) (proxyproto.Policy, error) {
+			addr, ok := opts.Upstream.(*net.TCPAddr)
+			// unix domain sockets are always local
+			if len(sources) == 0 || !ok || containsIP(sources, addr.IP) {
+				return proxyproto.REQUIRE, nil
+			}
+			return proxyproto.SKIP, nil
+		},
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// realIP replaces the remote address of requests from trusted proxies by
+// the client address of their Forwarded, X-Forwarded-For or X-Real-IP
+// header, so logging and rules see the address of the client
+func (app *application) realIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		trusted := app.config().trustedProxies
+		if len(trusted) > 0 {
+			if ip := net.ParseIP(clientIP(r)); ip != nil && containsIP(trusted, ip) {
+				if client, ok := forwardedClient(r.Header, trusted); ok {
+					r.RemoteAddr = client
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// forwardedClient returns the client address of the forwarding headers.
+// Proxies append the address they received the request from, so the list
+// is walked from the end and the first address not of a trusted proxy is
+// the client, addresses before it could be forged by the client.
+func forwardedClient(h http.Header, trusted []*net.IPNet) (string, bool) {
+	hops := forwardedHops(h)
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil {
+			// obfuscated or unknown addresses end the chain
+			return "", false
+		}
+		if i == 0 || !containsIP(trusted, ip) {
+			return ip.String(), true
+		}
+	}
+	return "", false
+}
+
+// forwardedHops returns the addresses of the Forwarded header or, if it is
+// not set, of the X-Forwarded-For or X-Real-IP header
+func forwardedHops(h http.Header) []string {
+	var hops []string
+	for _, value := range h.Values("Forwarded") {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					hops = append(hops, forwardedNode(strings.Trim(v, `"`)))
+				}
+			}
+		}
+	}
+	if len(hops) > 0 {
+		return hops
+	}
+	for _, value := range h.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(value, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	if len(hops) > 0 {
+		return hops
+	}
+	if ip := strings.TrimSpace(h.Get("X-Real-IP")); ip != "" {
+		return []string{ip}
+	}
+	return nil
+}
+
+// forwardedNode strips the port and the brackets of IPv6 addresses from a
+// node of the Forwarded header like "[2001:db8::1]:4711" or 192.0.2.1:80
+func forwardedNode(node string) string {
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(node, "["), "]")
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const redisTimeout = time.Second
+
+// redisBackoff is the time lookups are skipped after Redis failed, so
+// requests do not wait for redisTimeout while it is unavailable
+const redisBackoff = 5 * time.Second
+
+type redisConfig struct {
+	// URL of the server, e.g. redis://:password@127.0.0.1:6379/0
+	URL    string `yaml:"url"`
+	Prefix string `yaml:"prefix"`
+	// CacheTTL is the time lookups are cached, including misses
+	CacheTTL  time.Duration `yaml:"cache_ttl"`
+	CacheSize int           `yaml:"cache_size"`
+}
+
+// redisLink is the value of a key, either a plain target or a JSON object
+type redisLink struct {
+	Target string `json:"target"`
+	Status int    `json:"status"`
+}
+
+type redisEntry struct {
+	link    *redisLink
+	expires time.Time
+}
+
+// redisStore looks up every request in redis before the rules are
+// evaluated, so replicas share a rule set other tools can change at
+// runtime. The key is the prefix followed by host and path, e.g.
+// redirector:example.com/docs, or the prefix followed by the path for all
+// hosts, e.g. redirector:/docs.
+type redisStore struct {
+	client *redis.Client
+	prefix string
+	ttl    time.Duration
+	size   int
+
+	mu    sync.Mutex
+	cache map[string]redisEntry
+	// failed is the time of the last failed lookup
+	failed time.Time
+}
+
+func (c redisConfig) validate() error {
+	if c.URL == "" {
+		return nil
+	}
+	if _, err := redis.ParseURL(c.URL); err != nil {
+		return fmt.Errorf("invalid redis url: %w", err)
+	}
+	return nil
+}
+
+func openRedisStore(c redisConfig) (*redisStore, error) {
+	opts, err := redis.ParseURL(c.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url: %w", err)
+	}
+	opts.ReadTimeout = redisTimeout
+	opts.WriteTimeout = redisTimeout
+	return &redisStore{
+		client: redis.NewClient(opts),
+		prefix: c.Prefix,
+		ttl:    c.CacheTTL,
+		size:   c.CacheSize,
+		cache:  make(map[string]redisEntry),
+	}, nil
+}
+
+func (s *redisStore) name() string {
+	return "redis"
+}
+
+func (s *redisStore) ping(ctx context.Context) error {
+	return s.client.Ping(ctx).Err()
+}
+
+func (s *redisStore) Close() error {
+	return s.client.Close()
+}
+
+func (s *redisStore) decide(r *http.Request) (string, int, bool, error) {
+	key := requestHost(r) + r.URL.Path
+	link, err := s.lookup(r.Context(), key, r.URL.Path)
+	if err != nil || link == nil {
+		return "", 0, false, err
+	}
+	return link.Target, link.Status, true, nil
+}
+
+func (s *redisStore) lookup(ctx context.Context, key, path string) (*redisLink, error) {
+	s.mu.Lock()
+	entry, ok := s.cache[key]
+	failed := s.failed
+	s.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.link, nil
+	}
+	if time.Since(failed) < redisBackoff {
+		return nil, nil
+	}
+
+	lookupCtx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+	values, err := s.client.MGet(lookupCtx, s.prefix+key, s.prefix+path).Result()
+	if err != nil {
+		// requests canceled by the client do not mean redis is down
+		if ctx.Err() == nil {
+			s.mu.Lock()
+			s.failed = time.Now()
+			s.mu.Unlock()
+			return nil, fmt.Errorf("could not look up %s in redis, skipping lookups for %s: %w", key, redisBackoff, err)
+		}
+		return nil, fmt.Errorf("could not look up %s in redis: %w", key, err)
+	}
+	var link *redisLink
+	for _, v := range values {
+		if value, ok := v.(string); ok {
+			if link, err = parseRedisLink(value); err != nil {
+				return nil, fmt.Errorf("invalid redis value for %s: %w", key, err)
+			}
+			break
+		}
+	}
+
+	if s.ttl > 0 {
+		s.mu.Lock()
+		// simply start over once the cache is full
+		if len(s.cache) >= s.size {
+			clear(s.cache)
+		}
+		s.cache[key] = redisEntry{link: link, expires: time.Now().Add(s.ttl)}
+		s.mu.Unlock()
+	}
+	return link, nil
+}
+
+func parseRedisLink(value string) (*redisLink, error) {
+	value = strings.TrimSpace(value)
+	link := redisLink{Target: value}
+	if strings.HasPrefix(value, "{") {
+		link = redisLink{}
+		if err := json.Unmarshal([]byte(value), &link); err != nil {
+			return nil, err
+		}
+	}
+	// an empty location would redirect the client to the same URL again
+	if link.Target == "" {
+		return nil, fmt.Errorf("missing target")
+	}
+	if err := validateTarget(link.Target); err != nil {
+		return nil, err
+	}
+	if link.Status != 0 && !validRedirectStatus(link.Status) {
+		return nil, fmt.Errorf("invalid status %d", link.Status)
+	}
+	return &link, nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"syscall"
+	"time"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// reload reads the config file, environment and flags again and swaps the
+// active config if it is valid. Requests in flight finish with the old
+// config, settings of the listeners only take effect after a restart.
+func (app *application) reload() (err error) {
+	app.reloadMu.Lock()
+	defer app.reloadMu.Unlock()
+	defer func() { app.reloads.record(err) }()
+
+	cfg, err := parseConfig(os.Args[1:])
+	if err != nil {
+		return err
+	}
+	if err := cfg.prepare(); err != nil {
+		cfg.close()
+		return err
+	}
+	old := app.config()
+	if !reflect.DeepEqual(cfg.Listen, old.Listen) {
+		reloadLog.WithFields(logFields{
+			"old": fmt.Sprintf("%+v", old.Listen),
+			"new": fmt.Sprintf("%+v", cfg.Listen),
+		}).Warn("listen addresses changed, a restart is required to apply them")
+	}
+	// the files of certificates are replaced at runtime, switching between
+	// files, ACME and plain HTTP or other protocol settings require a restart
+	if cfg.TLS.enabled() != old.TLS.enabled() || (len(cfg.TLS.files()) == 0) != (len(old.TLS.files()) == 0) ||
+		!reflect.DeepEqual(cfg.TLS.listener(), old.TLS.listener()) {
+		reloadLog.Warn("tls settings changed, a restart is required to apply them")
+	}
+	if !reflect.DeepEqual(listenerLayout(cfg), listenerLayout(old)) {
+		reloadLog.Warn("listeners changed, a restart is required to apply their addresses and tls settings")
+	}
+	if cfg.Timeouts != old.Timeouts {
+		reloadLog.Warn("timeouts changed, a restart is required to apply them")
+	}
+	if before, after := old.Limits, cfg.Limits; before.MaxHeaderBytes != after.MaxHeaderBytes ||
+		before.MaxConnections != after.MaxConnections || before.MaxConnectionsPerIP != after.MaxConnectionsPerIP {
+		reloadLog.Warn("connection limits changed, a restart is required to apply them")
+	}
+	if !reflect.DeepEqual(cfg.StatsD, old.StatsD) {
+		reloadLog.Warn("statsd settings changed, a restart is required to apply them")
+	}
+	if cfg.OTLP != old.OTLP {
+		reloadLog.Warn("otlp settings changed, a restart is required to apply them")
+	}
+	if cfg.Logging.Output != old.Logging.Output || cfg.Logging.AccessOutput != old.Logging.AccessOutput ||
+		cfg.Logging.Rotation != old.Logging.Rotation || cfg.Logging.Syslog != old.Logging.Syslog {
+		reloadLog.Warn("log output changed, a restart is required to apply it")
+	}
+	if cfg.PProf != old.PProf {
+		reloadLog.Warn("pprof changed, a restart is required to apply it")
+	}
+	app.storeCertificates(cfg.certificates)
+	keepCanaries(cfg.Rules, old.Rules)
+	keepEnabled(cfg.Rules, old.Rules)
+	app.setConfig(cfg)
+	app.startKVWatchers()
+	configureLogging(cfg.Logging)
+	app.retire(old)
+	reloadLog.WithFields(configDiff(old, cfg)).Infof("config reloaded, %d rules active", len(cfg.Rules))
+	return nil
+}
+
+// listenerLayout returns the settings of the further listeners applied when
+// they start, their certificate files and default redirects change at
+// runtime
+func listenerLayout(cfg *config) []listenerConfig {
+	layout := make([]listenerConfig, len(cfg.Listeners))
+	for i, l := range cfg.Listeners {
+		layout[i] = listenerConfig{Name: l.Name, Address: l.Address, TLS: l.TLS.listener(), ProxyProtocol: l.ProxyProtocol}
+		if len(l.TLS.files()) > 0 {
+			layout[i].TLS.Cert = "files"
+		}
+	}
+	return layout
+}
+
+// configDiff describes the changes of a reload for the log: the rules added,
+// removed and changed, named by their id or host and path, and the top level
+// settings that changed. Values of settings are left out as they can
+// contain credentials.
+func configDiff(old, cfg *config) logFields {
+	fields := logFields{}
+	before, after := ruleVersions(old.Rules), ruleVersions(cfg.Rules)
+	var added, removed, changed []string
+	for name, encoded := range after {
+		prev, ok := before[name]
+		switch {
+		case !ok:
+			added = append(added, name)
+		case prev != encoded:
+			changed = append(changed, name)
+		}
+	}
+	for name := range before {
+		if _, ok := after[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	for key, names := range map[string][]string{"rules_added": added, "rules_removed": removed, "rules_changed": changed} {
+		if len(names) > 0 {
+			sort.Strings(names)
+			fields[key] = names
+		}
+	}
+	if settings := changedSettings(old, cfg); len(settings) > 0 {
+		fields["settings_changed"] = settings
+	}
+	return fields
+}
+
+// ruleVersions returns the encoded rules by name, rules sharing a name are
+// numbered in their order
+func ruleVersions(rules []rule) map[string]string {
+	versions := make(map[string]string, len(rules))
+	for i := range rules {
+		ru := &rules[i]
+		name := ru.ID
+		if name == "" {
+			name = ru.String()
+		}
+		if _, ok := versions[name]; ok {
+			for n := 2; ; n++ {
+				if _, ok := versions[fmt.Sprintf("%s#%d", name, n)]; !ok {
+					name = fmt.Sprintf("%s#%d", name, n)
+					break
+				}
+			}
+		}
+		encoded, _ := yaml.Marshal(ru)
+		versions[name] = string(encoded)
+	}
+	return versions
+}
+
+// changedSettings returns the top level settings besides the rules that
+// differ between the configs
+func changedSettings(old, cfg *config) []string {
+	a, errA := settingsMap(old)
+	b, errB := settingsMap(cfg)
+	if errA != nil || errB != nil {
+		return nil
+	}
+	var changed []string
+	for key, value := range b {
+		if !reflect.DeepEqual(a[key], value) {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+func settingsMap(cfg *config) (map[string]any, error) {
+	encoded, err := yaml.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]any
+	if err := yaml.Unmarshal(encoded, &m); err != nil {
+		return nil, err
+	}
+	delete(m, "rules")
+	return m, nil
+}
+
+// keepEnabled carries rules enabled or disabled at runtime over to the new
+// rules unless their configured state was changed
+func keepEnabled(rules, old []rule) {
+	for i := range rules {
+		ru := &rules[i]
+		if ru.ID == "" {
+			continue
+		}
+		prev := findRule(old, ru.ID)
+		if prev != nil && reflect.DeepEqual(prev.Enabled, ru.Enabled) {
+			ru.disabled.Store(prev.disabled.Load())
+		}
+	}
+}
+
+// retire closes the old config once the requests still using it had time to
+// finish, or on shutdown
+func (app *application) retire(old *config) {
+	app.retiredMu.Lock()
+	defer app.retiredMu.Unlock()
+	if app.retired == nil {
+		app.retired = make(map[*config]bool)
+	}
+	app.retired[old] = true
+	time.AfterFunc(old.Timeouts.Graceful, func() {
+		old.close()
+		app.retiredMu.Lock()
+		delete(app.retired, old)
+		app.retiredMu.Unlock()
+	})
+}
+
+// closeConfigs closes the active and all retired configs
+func (app *application) closeConfigs() {
+	app.retiredMu.Lock()
+	defer app.retiredMu.Unlock()
+	for cfg := range app.retired {
+		cfg.close()
+	}
+	app.config().close()
+}
+
+// keepCanaries carries canary percentages changed at runtime over to the
+// new rules unless the configured percentage was changed
+func keepCanaries(rules, old []rule) {
+	for i := range rules {
+		ru := &rules[i]
+		if ru.Canary == nil {
+			continue
+		}
+		prev := findRule(old, ru.ID)
+		if prev != nil && prev.Canary != nil && prev.Canary.Percent == ru.Canary.Percent {
+			ru.Canary.current.Store(prev.Canary.current.Load())
+		}
+	}
+}
+
+// reloadOnSignal reloads the config on every SIGHUP
+func (app *application) reloadOnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		if err := app.reload(); err != nil {
+			reloadLog.Errorf("could not reload config, keeping the current one: %v", err)
+		}
+	}
+}
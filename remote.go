@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	remoteTimeout = 10 * time.Second
+	// remoteMaxSize limits the size of remote config and rules files
+	remoteMaxSize = 10 << 20
+)
+
+var remoteClient = &http.Client{Timeout: remoteTimeout}
+
+// remoteFile is the last fetched version of a remote file
+type remoteFile struct {
+	etag         string
+	lastModified string
+	content      []byte
+}
+
+// remoteFiles caches remote files so they are only transferred again once
+// they changed
+var remoteFiles = struct {
+	sync.Mutex
+	m map[string]*remoteFile
+}{m: make(map[string]*remoteFile)}
+
+// isRemote reports if the file is fetched over http(s) or from S3 or GCS
+func isRemote(name string) bool {
+	for _, scheme := range []string{"http://", "https://", "s3://", "gs://"} {
+		if strings.HasPrefix(name, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+func newRemoteRequest(ctx context.Context, name string) (*http.Request, error) {
+	u, err := url.Parse(name)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "s3" || u.Scheme == "gs" {
+		return newObjectRequest(ctx, u)
+	}
+	return http.NewRequestWithContext(ctx, http.MethodGet, name, nil)
+}
+
+// fetchRemote returns the content of the URL. It sends the ETag and
+// Last-Modified of the cached version and returns the cached content if the
+// server answers with 304 Not Modified. changed reports if the content
+// differs from the cached version.
+func fetchRemote(url string) (content []byte, changed bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), remoteTimeout)
+	defer cancel()
+
+	remoteFiles.Lock()
+	cached := remoteFiles.m[url]
+	remoteFiles.Unlock()
+
+	req, err := newRemoteRequest(ctx, url)
+	if err != nil {
+		return nil, false, err
+	}
+	if cached != nil {
+		if cached.etag != "" {
+			req.Header.Set("If-None-Match", cached.etag)
+		}
+		if cached.lastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.lastModified)
+		}
+	}
+	resp, err := remoteClient.Do(req)
+	if err != nil {
+		return nil, false, fmt.Errorf("could not fetch %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached != nil:
+		return cached.content, false, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, false, fmt.Errorf("could not fetch %s: unexpected status %s", url, resp.Status)
+	}
+	content, err = io.ReadAll(io.LimitReader(resp.Body, remoteMaxSize+1))
+	if err != nil {
+		return nil, false, fmt.Errorf("could not fetch %s: %w", url, err)
+	}
+	if len(content) > remoteMaxSize {
+		return nil, false, fmt.Errorf("%s is larger than %d bytes", url, remoteMaxSize)
+	}
+	changed = cached == nil || string(cached.content) != string(content)
+	remoteFiles.Lock()
+	remoteFiles.m[url] = &remoteFile{
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+		content:      content,
+	}
+	remoteFiles.Unlock()
+	return content, changed, nil
+}
+
+// remoteSources returns the remote files the config was built from
+func (cfg *config) remoteSources() []string {
+	var sources []string
+	for _, name := range append([]string{cfg.file, cfg.RulesFile}, cfg.includes...) {
+		if isRemote(name) {
+			sources = append(sources, name)
+		}
+	}
+	return sources
+}
+
+// pollRemote checks the remote files on every interval and reloads the
+// config once one of them changed. A failed reload is retried on the next
+// interval, the cache already holds the new content and reports no change.
+func (app *application) pollRemote(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	pending := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		changed := pending
+		for _, url := range app.config().remoteSources() {
+			_, c, err := fetchRemote(url)
+			if err != nil {
+				reloadLog.Error(err)
+				continue
+			}
+			changed = changed || c
+		}
+		if !changed {
+			continue
+		}
+		if !pending {
+			reloadLog.Info("remote config changed")
+		}
+		pending = false
+		if err := app.reload(); err != nil {
+			reloadLog.Errorf("could not reload config, keeping the current one: %v", err)
+			pending = true
+		}
+	}
+}
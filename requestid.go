@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+const (
+	defaultRequestIDHeader = "X-Request-ID"
+	// maxRequestIDLength limits the ids taken over from clients and proxies
+	maxRequestIDLength = 128
+)
+
+type requestIDKey struct{}
+
+// requestID takes the id of the request from the request id header set by
+// a proxy or client or generates one. It is sent back in the same header
+// and written to the logs of the request, so a reported redirect can be
+// found in them.
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := app.config().RequestIDHeader
+		if header == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		id := r.Header.Get(header)
+		if !validRequestID(id) {
+			id = uuid.NewString()
+			r.Header.Set(header, id)
+		}
+		w.Header().Set(header, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// validRequestID accepts printable ids without spaces, others are replaced
+// so they can not break the log lines
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range []byte(id) {
+		if c <= ' ' || c > '~' || c == '"' || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDFromContext returns the id of the request, empty if disabled
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestLog returns the logger adding the id of the request to entries
+func requestLog(r *http.Request) *logger {
+	if id := requestIDFromContext(r.Context()); id != "" {
+		return log.WithFields(logFields{"request_id": id})
+	}
+	return log
+}
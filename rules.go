@@ -0,0 +1,513 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/cel-go/cel"
+)
+
+const (
+	actionRedirect     = ""
+	actionGone         = "gone"
+	actionMetaRefresh  = "meta-refresh"
+	actionJavascript   = "javascript"
+	actionInterstitial = "interstitial"
+)
+
+// rule maps a request host and/or path to a redirect target. An empty host
+// or path matches every request.
+type rule struct {
+	// ID identifies the rule in the admin api
+	ID   string `yaml:"id,omitempty"`
+	Host string `yaml:"host,omitempty"`
+	// Path is matched exactly, a path ending in /* matches the prefix itself
+	// and everything below it
+	Path string `yaml:"path,omitempty"`
+	// Regex is matched against the path, its capture groups can be
+	// referenced in the target as $1 or ${name}
+	Regex string `yaml:"regex,omitempty"`
+	// Glob supports * for a single path segment, ** for any number of
+	// segments and ? for a single character
+	Glob       string `yaml:"glob,omitempty"`
+	IgnoreCase bool   `yaml:"ignore_case,omitempty"`
+	// Device limits the rule to mobile, desktop, ios or android clients,
+	// UserAgent to user agents matching the regex
+	Device    string `yaml:"device,omitempty"`
+	UserAgent string `yaml:"user_agent,omitempty"`
+	// Cookies limits the rule to requests carrying these cookies, an empty
+	// value matches any value
+	Cookies map[string]string `yaml:"cookies,omitempty"`
+	// Headers limits the rule to requests with matching headers, all of
+	// them have to match unless HeadersMatch is any
+	Headers      []headerCondition `yaml:"headers,omitempty"`
+	HeadersMatch string            `yaml:"headers_match,omitempty"`
+	// Expr is a CEL expression that has to evaluate to true
+	Expr string `yaml:"expr,omitempty"`
+	// Listeners limits the rule to requests received by these listeners
+	Listeners []string `yaml:"listeners,omitempty"`
+	// Action defines how the request is answered, defaults to a redirect
+	Action string `yaml:"action,omitempty"`
+	Target string `yaml:"target,omitempty"`
+	// Targets splits the traffic across multiple targets by their weight
+	Targets []weightedTarget `yaml:"targets,omitempty"`
+	// Sticky pins visitors of a split to one target by hashing their ip or
+	// a cookie, e.g. ip or cookie:session
+	Sticky string `yaml:"sticky,omitempty"`
+	// Canary receives a percentage of the traffic adjustable at runtime
+	Canary *canaryTarget `yaml:"canary,omitempty"`
+	// Languages maps preferred languages of the visitor to targets
+	Languages map[string]string `yaml:"languages,omitempty"`
+	// Countries maps ISO country codes of the client to targets or to block
+	Countries map[string]string `yaml:"countries,omitempty"`
+	// Body is an optional HTML body for gone and blocked responses
+	Body string `yaml:"body,omitempty"`
+	// Delay in seconds before an interstitial page forwards the visitor
+	Delay int `yaml:"delay,omitempty"`
+	// Status overrides the global redirect status code
+	Status int `yaml:"status,omitempty"`
+	// ResponseHeaders are added to the response, overriding global headers
+	ResponseHeaders map[string]string `yaml:"response_headers,omitempty"`
+	// CacheControl overrides the global Cache-Control of redirects
+	CacheControl string `yaml:"cache_control,omitempty"`
+	// Rules with a higher priority are evaluated first, rules with the same
+	// priority in the order they are declared
+	Priority int         `yaml:"priority,omitempty"`
+	Query    *queryRules `yaml:"query,omitempty"`
+	// ActiveFrom and ActiveUntil limit the rule to a time range, Windows to
+	// recurring times of the week in Timezone
+	ActiveFrom  time.Time    `yaml:"active_from,omitempty"`
+	ActiveUntil time.Time    `yaml:"active_until,omitempty"`
+	Windows     []timeWindow `yaml:"windows,omitempty"`
+	Timezone    string       `yaml:"timezone,omitempty"`
+	// Expires retires the rule, afterwards it answers with ExpiredStatus
+	// (404 or 410, default 410)
+	Expires       time.Time `yaml:"expires,omitempty"`
+	ExpiredStatus int       `yaml:"expired_status,omitempty"`
+	// Enabled false keeps the rule in the config without using it, it can
+	// be enabled at runtime using the admin listener
+	Enabled *bool `yaml:"enabled,omitempty"`
+
+	expiredStatus int
+	re            *regexp.Regexp
+	glob          *regexp.Regexp
+	ignoreCase    bool
+	trailingSlash string
+	geoip         *geoLocator
+	totalWeight   int
+	location      *time.Location
+	languages     map[string]string
+	countries     map[string]string
+	userAgent     *regexp.Regexp
+	expr          cel.Program
+	// source is the file and line the rule was read from
+	source string
+	// expiryLogged is set once the expiry of the rule was logged
+	expiryLogged atomic.Bool
+	// disabled is the current state of Enabled
+	disabled atomic.Bool
+}
+
+// loadRules reads a JSON or YAML file containing a list of rules. TOML has
+// no top level arrays so TOML files list them as [[rules]] tables. Key value
+// stores are read from etcd://, consul:// and k8s:// URLs. expand expands
+// the environment variables of the file.
+func loadRules(filename string, expand bool) ([]rule, error) {
+	if isKV(filename) {
+		return loadKVRules(filename)
+	}
+	var rules []rule
+	var content []byte
+	var err error
+	key := ""
+	if isTOML(filename) {
+		var doc struct {
+			Rules []rule `yaml:"rules"`
+		}
+		content, err = decodeFile(filename, &doc, expand)
+		rules = doc.Rules
+		key = "rules"
+	} else {
+		content, err = decodeFile(filename, &rules, expand)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not parse rules file %s: %w", filename, err)
+	}
+	setRuleSources(rules, filename, key, content)
+	return rules, nil
+}
+
+// prepareRules validates the rules of the config and sorts them by priority
+func (cfg *config) prepareRules() error {
+	ids := make(map[string]bool)
+	for i := range cfg.Rules {
+		if err := cfg.Rules[i].prepare(cfg); err != nil {
+			if source := cfg.Rules[i].source; source != "" {
+				return fmt.Errorf("invalid rule at %s: %w", source, err)
+			}
+			return fmt.Errorf("invalid rule #%d: %w", i+1, err)
+		}
+		if id := cfg.Rules[i].ID; id != "" {
+			if ids[id] {
+				return fmt.Errorf("duplicate rule id %q", id)
+			}
+			ids[id] = true
+		}
+	}
+
+	if err := checkDuplicateRules(cfg.Rules); err != nil {
+		return err
+	}
+
+	sort.SliceStable(cfg.Rules, func(i, j int) bool {
+		return cfg.Rules[i].Priority > cfg.Rules[j].Priority
+	})
+	warnShadowedRules(cfg.Rules)
+	return nil
+}
+
+// checkDuplicateRules fails if two unconditional rules match exactly the
+// same requests, which usually happens when rule sets of several files
+// overlap. Disabled rules are skipped so replacements can be staged.
+func checkDuplicateRules(rules []rule) error {
+	seen := make(map[string]*rule)
+	for i := range rules {
+		ru := &rules[i]
+		if ru.conditional() || ru.disabled.Load() {
+			continue
+		}
+		key := fmt.Sprintf("%s|%s|%s|%s|%t", strings.ToLower(ru.Host), ru.Path, ru.Regex, ru.Glob, ru.ignoreCase)
+		if prev, ok := seen[key]; ok {
+			return fmt.Errorf("rule %s%s duplicates rule %s%s", ru, sourceSuffix(ru), prev, sourceSuffix(prev))
+		}
+		seen[key] = ru
+	}
+	return nil
+}
+
+// sourceSuffix returns the source of the rule for error messages
+func sourceSuffix(ru *rule) string {
+	if ru.source == "" {
+		return ""
+	}
+	return " at " + ru.source
+}
+
+// warnShadowedRules logs a warning for every rule that can never match
+// because an earlier rule already matches all of its requests
+func warnShadowedRules(rules []rule) {
+	for i := range rules {
+		if rules[i].disabled.Load() {
+			continue
+		}
+		for j := 0; j < i; j++ {
+			if !rules[j].disabled.Load() && rules[j].covers(&rules[i]) {
+				log.Warnf("rule %s is unreachable as it is shadowed by rule %s", &rules[i], &rules[j])
+				break
+			}
+		}
+	}
+}
+
+// covers reports if the rule matches every request the other rule matches
+func (ru *rule) covers(other *rule) bool {
+	if ru.conditional() {
+		return false
+	}
+	if ru.Host != "" && !strings.EqualFold(ru.Host, other.Host) {
+		return false
+	}
+	if other.ignoreCase && !ru.ignoreCase {
+		return false
+	}
+	if ru.re != nil {
+		return other.re != nil && ru.Regex == other.Regex
+	}
+	if ru.glob != nil {
+		return other.glob != nil && ru.Glob == other.Glob
+	}
+	if ru.Path == "" {
+		return true
+	}
+	if other.re != nil || other.glob != nil || other.Path == "" {
+		return false
+	}
+	if strings.HasSuffix(ru.Path, "/*") {
+		return ru.matchesPath(strings.TrimSuffix(other.Path, "/*"))
+	}
+	return ru.matchesPath(other.Path)
+}
+
+// prepare validates the rule and compiles its regular expression
+func (ru *rule) prepare(cfg *config) error {
+	ru.disabled.Store(ru.Enabled != nil && !*ru.Enabled)
+	ru.ignoreCase = ru.IgnoreCase || cfg.IgnoreCase
+	ru.trailingSlash = cfg.TrailingSlash
+	ru.geoip = cfg.geoip
+	patterns := 0
+	for _, p := range []string{ru.Path, ru.Regex, ru.Glob} {
+		if p != "" {
+			patterns++
+		}
+	}
+	if patterns > 1 {
+		return fmt.Errorf("rule %s can only have one of path, regex and glob", ru)
+	}
+	if ru.Path != "" && !strings.HasPrefix(ru.Path, "/") {
+		return fmt.Errorf("path %q must start with /", ru.Path)
+	}
+	if !strings.HasSuffix(ru.Path, "/*") {
+		ru.Path = ru.normalizePath(ru.Path)
+	}
+	if err := ru.prepareSchedule(); err != nil {
+		return fmt.Errorf("rule %s: %w", ru, err)
+	}
+	if err := ru.prepareConditions(); err != nil {
+		return fmt.Errorf("rule %s: %w", ru, err)
+	}
+	for _, name := range ru.Listeners {
+		if name != mainListener && cfg.listener(name) == nil {
+			return fmt.Errorf("rule %s: unknown listener %q", ru, name)
+		}
+	}
+	if ru.Host == "" && patterns == 0 && !ru.hasConditions() {
+		return fmt.Errorf("rule needs a host, a path, a regex, a glob or a condition")
+	}
+	if ru.Glob != "" {
+		if !strings.HasPrefix(ru.Glob, "/") {
+			return fmt.Errorf("glob %q must start with /", ru.Glob)
+		}
+		ru.glob = compileGlob(ru.Glob, ru.ignoreCase)
+	}
+	if ru.Regex != "" {
+		expr := ru.Regex
+		if ru.ignoreCase {
+			expr = "(?i)" + expr
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("invalid regex %q: %w", ru.Regex, err)
+		}
+		ru.re = re
+	}
+	switch ru.Action {
+	case actionRedirect, actionMetaRefresh, actionJavascript, actionInterstitial:
+	case actionGone:
+		// retired urls do not need a target
+		return nil
+	default:
+		return fmt.Errorf("rule %s has invalid action %q", ru, ru.Action)
+	}
+	if ru.Target != "" && len(ru.Targets) > 0 {
+		return fmt.Errorf("rule %s can only have one of target and targets", ru)
+	}
+	if ru.Target == "" && len(ru.Targets) == 0 {
+		return fmt.Errorf("rule %s has no target", ru)
+	}
+	if err := validateWeightedTargets(ru.Targets); err != nil {
+		return fmt.Errorf("rule %s: %w", ru, err)
+	}
+	if err := validateSticky(ru.Sticky); err != nil {
+		return fmt.Errorf("rule %s: %w", ru, err)
+	}
+	languages, err := prepareLanguages(ru.Languages)
+	if err != nil {
+		return fmt.Errorf("rule %s: %w", ru, err)
+	}
+	ru.languages = languages
+	countries, err := prepareCountries(ru.Countries, cfg.GeoIP.Database)
+	if err != nil {
+		return fmt.Errorf("rule %s: %w", ru, err)
+	}
+	ru.countries = countries
+	if ru.Canary != nil {
+		if ru.ID == "" {
+			return fmt.Errorf("rule %s needs an id to use a canary", ru)
+		}
+		if err := ru.Canary.prepare(); err != nil {
+			return fmt.Errorf("rule %s: %w", ru, err)
+		}
+	}
+	for _, t := range ru.Targets {
+		ru.totalWeight += t.Weight
+	}
+	if ru.Delay < 0 {
+		return fmt.Errorf("rule %s has a negative delay", ru)
+	}
+	if ru.Status != 0 && !validRedirectStatus(ru.Status) {
+		return fmt.Errorf("rule %s has invalid status code %d", ru, ru.Status)
+	}
+	if ru.Target != "" {
+		return validateTarget(ru.Target)
+	}
+	return nil
+}
+
+// key identifies the rule in hit counters and metrics, its id or its host
+// and path
+func (ru *rule) key() string {
+	if ru.ID != "" {
+		return ru.ID
+	}
+	return ru.String()
+}
+
+// String returns a short description of what the rule matches
+func (ru *rule) String() string {
+	switch {
+	case ru.Regex != "":
+		return ru.Host + "~" + ru.Regex
+	case ru.Glob != "":
+		return ru.Host + ru.Glob
+	case ru.Host == "" && ru.Path == "":
+		return "*"
+	}
+	return ru.Host + ru.Path
+}
+
+// conditional reports if the rule is limited by conditions besides host
+// and path
+func (ru *rule) conditional() bool {
+	return ru.scheduled() || ru.hasConditions()
+}
+
+func (ru *rule) matches(r *http.Request) bool {
+	if ru.disabled.Load() {
+		return false
+	}
+	if ru.scheduled() && !ru.activeAt(time.Now()) {
+		return false
+	}
+	if ru.Host != "" && !strings.EqualFold(ru.Host, requestHost(r)) {
+		return false
+	}
+	if !ru.matchesPath(ru.normalizePath(r.URL.Path)) {
+		return false
+	}
+	return !ru.hasConditions() || ru.matchesConditions(r)
+}
+
+func (ru *rule) matchesPath(path string) bool {
+	if ru.re != nil {
+		return ru.re.MatchString(path)
+	}
+	if ru.glob != nil {
+		return ru.glob.MatchString(path)
+	}
+	if ru.Path == "" {
+		return true
+	}
+	rulePath := ru.Path
+	if ru.ignoreCase {
+		rulePath = strings.ToLower(rulePath)
+		path = strings.ToLower(path)
+	}
+	if prefix, ok := strings.CutSuffix(rulePath, "/*"); ok {
+		return path == prefix || strings.HasPrefix(path, prefix+"/")
+	}
+	return path == rulePath
+}
+
+// expandTarget returns the target of the rule with all regex capture groups
+// replaced by the values matched from the request path
+func (ru *rule) expandTarget(r *http.Request) string {
+	target := ru.selectTarget(r)
+	if ru.re == nil {
+		return target
+	}
+	path := ru.normalizePath(r.URL.Path)
+	submatches := ru.re.FindStringSubmatchIndex(path)
+	if submatches == nil {
+		return target
+	}
+	return string(ru.re.ExpandString(nil, target, path, submatches))
+}
+
+// compileGlob converts a glob pattern into an anchored regular expression.
+// A trailing /** also matches the directory itself.
+func compileGlob(pattern string, ignoreCase bool) *regexp.Regexp {
+	var sb strings.Builder
+	if ignoreCase {
+		sb.WriteString("(?i)")
+	}
+	sb.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case strings.HasPrefix(pattern[i:], "/**") && i+3 == len(pattern):
+			sb.WriteString("(/.*)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			sb.WriteString(".*")
+			i++
+		case pattern[i] == '*':
+			sb.WriteString("[^/]*")
+		case pattern[i] == '?':
+			sb.WriteString("[^/]")
+		default:
+			sb.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.MustCompile(sb.String())
+}
+
+// matchRule returns the first rule matching the request or nil if there is none
+func matchRule(rules []rule, r *http.Request) *rule {
+	for i := range rules {
+		if rules[i].matches(r) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// normalizePath removes a trailing slash from the path if trailing slashes
+// are not significant
+func (ru *rule) normalizePath(path string) string {
+	if ru.trailingSlash == trailingSlashStrict || path == "/" {
+		return path
+	}
+	return strings.TrimSuffix(path, "/")
+}
+
+// findRule returns the rule with the given id or nil if there is none
+func findRule(rules []rule, id string) *rule {
+	for i := range rules {
+		if rules[i].ID == id {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// requestHost returns the host of the request without the port
+func requestHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		return r.Host
+	}
+	return host
+}
+
+// clientIP returns the ip address of the client
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func validRedirectStatus(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
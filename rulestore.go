@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.yaml.in/yaml/v3"
+)
+
+const (
+	// hitFlushInterval is the interval counted hits are written to the store
+	hitFlushInterval = 10 * time.Second
+	// maxRuleSize limits the size of rules added through the admin api
+	maxRuleSize = 1 << 20
+	// maxPendingClicks limits the clicks kept while the storage is not
+	// available, further clicks are dropped
+	maxPendingClicks = 100000
+)
+
+// storage persists rules added at runtime, hit counters and click events
+type storage interface {
+	// listRules returns the stored rules in the order they were added
+	listRules() ([]storedRule, error)
+	// putRule adds or replaces the rule and returns the previous value,
+	// which is nil if the rule is new
+	putRule(id string, value json.RawMessage) (json.RawMessage, error)
+	// deleteRule removes the rule and reports if it existed
+	deleteRule(id string) (bool, error)
+	// addHits adds the hits of the rules and the clicks
+	addHits(hits map[string]int64, clicks []click, at time.Time) error
+	// hitCounts returns the hits of all rules, the most requested first
+	hitCounts() ([]hitCount, error)
+	// ping checks that the storage is reachable
+	ping(ctx context.Context) error
+	Close() error
+}
+
+// ruleStore keeps rules added through the admin api, hit counters of all
+// rules and optionally every click in a storage, so they survive restarts.
+// Hits are counted in memory and written in the background.
+type ruleStore struct {
+	storage
+	name   string
+	clicks bool
+
+	mu      sync.Mutex
+	hits    map[string]int64
+	pending []click
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// storedRule is a rule of the store, Rule is the rule as JSON
+type storedRule struct {
+	ID      string          `json:"id"`
+	Rule    json.RawMessage `json:"rule"`
+	Updated time.Time       `json:"updated"`
+}
+
+type hitCount struct {
+	Rule    string    `json:"rule"`
+	Hits    int64     `json:"hits"`
+	LastHit time.Time `json:"last_hit"`
+}
+
+// click is a single request matching a rule
+type click struct {
+	rule      string
+	time      time.Time
+	referer   string
+	userAgent string
+}
+
+func openRuleStore(name string, clicks bool) (*ruleStore, error) {
+	st, err := openSQLStore(name)
+	if err != nil {
+		return nil, fmt.Errorf("could not open store %s: %w", redactStore(name), err)
+	}
+	s := &ruleStore{
+		storage: st,
+		name:    redactStore(name),
+		clicks:  clicks,
+		hits:    make(map[string]int64),
+		done:    make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.flushHits()
+	return s, nil
+}
+
+// Close writes the pending hits and closes the storage
+func (s *ruleStore) Close() error {
+	close(s.done)
+	s.wg.Wait()
+	return s.storage.Close()
+}
+
+// rules decodes the stored rules, their sources refer to the store
+func (s *ruleStore) rules() ([]rule, error) {
+	stored, err := s.listRules()
+	if err != nil {
+		return nil, fmt.Errorf("could not read rules from %s: %w", s.name, err)
+	}
+	rules := make([]rule, len(stored))
+	for i, sr := range stored {
+		if err := decodeStoredRule(&rules[i], sr.ID, sr.Rule); err != nil {
+			return nil, fmt.Errorf("invalid rule %s in %s: %w", sr.ID, s.name, err)
+		}
+		rules[i].source = s.name + ":" + sr.ID
+	}
+	return rules, nil
+}
+
+// hit counts a request matching the rule
+func (s *ruleStore) hit(ru *rule, r *http.Request) {
+	key := ru.key()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hits[key]++
+	if s.clicks && len(s.pending) < maxPendingClicks {
+		s.pending = append(s.pending, click{
+			rule:      key,
+			time:      time.Now().UTC(),
+			referer:   r.Referer(),
+			userAgent: r.UserAgent(),
+		})
+	}
+}
+
+func (s *ruleStore) flushHits() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(hitFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			s.writeHits()
+			return
+		case <-ticker.C:
+			s.writeHits()
+		}
+	}
+}
+
+// writeHits writes the counted hits, they are kept for the next attempt if
+// the storage is not available
+func (s *ruleStore) writeHits() {
+	s.mu.Lock()
+	hits, clicks := s.hits, s.pending
+	s.hits, s.pending = make(map[string]int64), nil
+	s.mu.Unlock()
+	if len(hits) == 0 {
+		return
+	}
+	if err := s.addHits(hits, clicks, time.Now().UTC()); err != nil {
+		storeLog.Errorf("could not write hits to %s: %v", s.name, err)
+		s.mu.Lock()
+		for key, n := range hits {
+			s.hits[key] += n
+		}
+		if room := maxPendingClicks - len(s.pending); room > 0 {
+			s.pending = append(s.pending, clicks[:min(room, len(clicks))]...)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// decodeStoredRule decodes a rule given as JSON or YAML, the id of the
+// store overrides an id in the rule
+func decodeStoredRule(ru *rule, id string, value []byte) error {
+	dec := yaml.NewDecoder(bytes.NewReader(value))
+	dec.KnownFields(true)
+	if err := dec.Decode(ru); err != nil {
+		return err
+	}
+	ru.ID = id
+	return nil
+}
+
+// normalizeStoredRule converts a rule given as JSON or YAML to JSON
+func normalizeStoredRule(value []byte) (json.RawMessage, error) {
+	var v map[string]any
+	if err := yaml.Unmarshal(value, &v); err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, fmt.Errorf("empty rule")
+	}
+	return json.Marshal(v)
+}
+
+func (app *application) store(w http.ResponseWriter) *ruleStore {
+	store := app.config().store
+	if store == nil {
+		http.Error(w, "no store configured", http.StatusNotFound)
+	}
+	return store
+}
+
+func (app *application) storeListHandler(w http.ResponseWriter, r *http.Request) {
+	store := app.store(w)
+	if store == nil {
+		return
+	}
+	stored, err := store.listRules()
+	if err != nil {
+		app.logError(w, r, err, false)
+		return
+	}
+	if stored == nil {
+		stored = []storedRule{}
+	}
+	app.writeJSON(w, http.StatusOK, stored)
+}
+
+// storePutHandler adds or replaces a rule and reloads the config. The change
+// is reverted if the config is invalid with it.
+func (app *application) storePutHandler(w http.ResponseWriter, r *http.Request) {
+	store := app.store(w)
+	if store == nil {
+		return
+	}
+	id := ruleID(r)
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRuleSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	value, err := normalizeStoredRule(body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid rule: %v", err), http.StatusBadRequest)
+		return
+	}
+	var ru rule
+	err = decodeStoredRule(&ru, id, value)
+	if err == nil {
+		err = ru.prepare(app.config())
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid rule: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	app.storeMu.Lock()
+	defer app.storeMu.Unlock()
+	old, err := store.putRule(id, value)
+	if err != nil {
+		app.logError(w, r, err, false)
+		return
+	}
+	if err := app.reload(); err != nil {
+		var revertErr error
+		if old != nil {
+			_, revertErr = store.putRule(id, old)
+		} else {
+			_, revertErr = store.deleteRule(id)
+		}
+		if revertErr != nil {
+			storeLog.Errorf("could not revert rule %s: %v", id, revertErr)
+		}
+		http.Error(w, fmt.Sprintf("could not apply rule: %v", err), http.StatusBadRequest)
+		return
+	}
+	storeLog.Infof("rule %s stored", id)
+	app.writeJSON(w, http.StatusOK, storedRule{ID: id, Rule: value, Updated: time.Now().UTC()})
+}
+
+func (app *application) storeDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	store := app.store(w)
+	if store == nil {
+		return
+	}
+	id := ruleID(r)
+	app.storeMu.Lock()
+	defer app.storeMu.Unlock()
+	ok, err := store.deleteRule(id)
+	if err != nil {
+		app.logError(w, r, err, false)
+		return
+	}
+	if !ok {
+		http.Error(w, fmt.Sprintf("no stored rule with id %q", id), http.StatusNotFound)
+		return
+	}
+	if err := app.reload(); err != nil {
+		storeLog.Errorf("could not reload config after deleting rule %s: %v", id, err)
+	}
+	storeLog.Infof("rule %s deleted", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (app *application) hitsHandler(w http.ResponseWriter, r *http.Request) {
+	store := app.store(w)
+	if store == nil {
+		return
+	}
+	counts, err := store.hitCounts()
+	if err != nil {
+		app.logError(w, r, err, false)
+		return
+	}
+	app.writeJSON(w, http.StatusOK, counts)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// timeWindow is a recurring window in which a rule is active, e.g. on
+// weekdays from 09:00 to 17:00. A window with until before from spans
+// midnight. No days means every day.
+type timeWindow struct {
+	Days  []string `yaml:"days,omitempty"`
+	From  string   `yaml:"from,omitempty"`
+	Until string   `yaml:"until,omitempty"`
+
+	days  map[time.Weekday]bool
+	from  time.Duration
+	until time.Duration
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func (tw *timeWindow) prepare() error {
+	tw.days = make(map[time.Weekday]bool)
+	for _, d := range tw.Days {
+		wd, ok := weekdays[strings.ToLower(d)]
+		if !ok {
+			return fmt.Errorf("invalid day %q", d)
+		}
+		tw.days[wd] = true
+	}
+	var err error
+	if tw.from, err = parseTimeOfDay(tw.From); err != nil {
+		return err
+	}
+	if tw.until, err = parseTimeOfDay(tw.Until); err != nil {
+		return err
+	}
+	return nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (tw *timeWindow) contains(t time.Time) bool {
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	day := t.Weekday()
+	if tw.from <= tw.until {
+		return tw.onDay(day) && offset >= tw.from && offset < tw.until
+	}
+	// the window spans midnight, the part after midnight belongs to the
+	// window started on the previous day
+	if offset >= tw.from {
+		return tw.onDay(day)
+	}
+	return offset < tw.until && tw.onDay((day+6)%7)
+}
+
+func (tw *timeWindow) onDay(day time.Weekday) bool {
+	return len(tw.days) == 0 || tw.days[day]
+}
+
+// prepareSchedule validates the scheduling fields of the rule
+func (ru *rule) prepareSchedule() error {
+	switch ru.ExpiredStatus {
+	case 0:
+		ru.expiredStatus = http.StatusGone
+	case http.StatusGone, http.StatusNotFound:
+		ru.expiredStatus = ru.ExpiredStatus
+	default:
+		return fmt.Errorf("expired_status must be 404 or 410")
+	}
+	ru.location = time.Local
+	if ru.Timezone != "" {
+		loc, err := time.LoadLocation(ru.Timezone)
+		if err != nil {
+			return fmt.Errorf("invalid timezone %q: %w", ru.Timezone, err)
+		}
+		ru.location = loc
+	}
+	if !ru.ActiveFrom.IsZero() && !ru.ActiveUntil.IsZero() && !ru.ActiveUntil.After(ru.ActiveFrom) {
+		return fmt.Errorf("active_until must be after active_from")
+	}
+	for i := range ru.Windows {
+		if err := ru.Windows[i].prepare(); err != nil {
+			return fmt.Errorf("invalid window #%d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// scheduled reports if the rule is only active at certain times
+func (ru *rule) scheduled() bool {
+	return !ru.ActiveFrom.IsZero() || !ru.ActiveUntil.IsZero() || len(ru.Windows) > 0
+}
+
+// activeAt reports if the rule is active at the given time
+func (ru *rule) activeAt(t time.Time) bool {
+	if !ru.ActiveFrom.IsZero() && t.Before(ru.ActiveFrom) {
+		return false
+	}
+	if !ru.ActiveUntil.IsZero() && !t.Before(ru.ActiveUntil) {
+		return false
+	}
+	if len(ru.Windows) == 0 {
+		return true
+	}
+	local := t.In(ru.location)
+	for i := range ru.Windows {
+		if ru.Windows[i].contains(local) {
+			return true
+		}
+	}
+	return false
+}
+
+// expiredAt reports if the rule is expired at the given time
+func (ru *rule) expiredAt(t time.Time) bool {
+	return !ru.Expires.IsZero() && !t.Before(ru.Expires)
+}
+
+// logExpiredRules logs all rules that expired since the last call
+func logExpiredRules(rules []rule, now time.Time) {
+	for i := range rules {
+		ru := &rules[i]
+		if ru.expiredAt(now) && !ru.expiryLogged.Swap(true) {
+			log.Infof("rule %s expired at %s and answers with %d from now on", ru, ru.Expires.Format(time.RFC3339), ru.expiredStatus)
+		}
+	}
+}
+
+// watchExpiredRules logs expiring rules once a minute until the context is
+// canceled
+func (app *application) watchExpiredRules(ctx context.Context) {
+	logExpiredRules(app.config().Rules, time.Now())
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			logExpiredRules(app.config().Rules, now)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/activation"
+)
+
+const (
+	// unixPrefix marks listen addresses of unix domain sockets, e.g.
+	// unix:/run/redirector.sock
+	unixPrefix = "unix:"
+	// systemdPrefix marks listen addresses of sockets passed by systemd,
+	// followed by the FileDescriptorName of the socket, e.g.
+	// systemd:redirector.socket
+	systemdPrefix = "systemd:"
+)
+
+// systemdSockets are the sockets passed by systemd socket activation by
+// their name, they are taken out once a listener uses them
+var systemdSockets = struct {
+	sync.Mutex
+	sockets map[string][]net.Listener
+	err     error
+}{}
+
+// socketOptions are the settings of the sockets of all listeners: the
+// permissions of unix domain sockets and the tuning of TCP sockets
+type socketOptions struct {
+	mode     fs.FileMode
+	hasMode  bool
+	uid, gid int
+
+	keepAlive time.Duration
+	reusePort bool
+	backlog   int
+}
+
+// parseSocketOptions parses the socket settings of the listen config, the
+// mode as octal number and the owner as user, user:group or :group
+func parseSocketOptions(l listenConfig) (socketOptions, error) {
+	if l.Backlog < 0 {
+		return socketOptions{}, fmt.Errorf("invalid backlog %d", l.Backlog)
+	}
+	opts := socketOptions{uid: -1, gid: -1, keepAlive: l.TCPKeepAlive, reusePort: l.ReusePort, backlog: l.Backlog}
+	mode, owner := l.SocketMode, l.SocketOwner
+	if mode != "" {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || m > 0o777 {
+			return opts, fmt.Errorf("invalid socket mode %q, expected an octal mode like 0660", mode)
+		}
+		opts.mode, opts.hasMode = fs.FileMode(m), true
+	}
+	if owner == "" {
+		return opts, nil
+	}
+	name, group, _ := strings.Cut(owner, ":")
+	if name != "" {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return opts, fmt.Errorf("invalid socket owner: %w", err)
+		}
+		opts.uid, _ = strconv.Atoi(u.Uid)
+	}
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return opts, fmt.Errorf("invalid socket group: %w", err)
+		}
+		opts.gid, _ = strconv.Atoi(g.Gid)
+	}
+	return opts, nil
+}
+
+// listen uses the socket of the address passed by the previous process of
+// an upgrade or opens a new one. The socket is kept for the next upgrade.
+func listen(address string, opts socketOptions) (net.Listener, error) {
+	ln, err := inheritedListener(address)
+	if ln == nil && err == nil {
+		ln, err = openListener(address, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := ln.(fileSocket); ok {
+		keepSocket(address, s)
+	}
+	return ln, nil
+}
+
+// openListener opens a TCP listener or, for addresses starting with unix:,
+// a unix domain socket with the configured permissions. A socket left over
+// by a previous run is removed. Addresses starting with systemd: use a
+// socket passed by systemd, which is configured in its socket unit.
+func openListener(address string, opts socketOptions) (net.Listener, error) {
+	if name, ok := strings.CutPrefix(address, systemdPrefix); ok {
+		return systemdListener(name)
+	}
+	path, ok := strings.CutPrefix(address, unixPrefix)
+	if !ok {
+		lc := net.ListenConfig{KeepAlive: opts.keepAlive}
+		if opts.reusePort {
+			lc.Control = reusePort
+		}
+		ln, err := lc.Listen(context.Background(), "tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		return withBacklog(ln, opts.backlog)
+	}
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&fs.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if opts.hasMode {
+		err = os.Chmod(path, opts.mode)
+	}
+	if err == nil && (opts.uid != -1 || opts.gid != -1) {
+		err = os.Lchown(path, opts.uid, opts.gid)
+	}
+	if err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("could not set permissions of %s: %w", path, err)
+	}
+	return withBacklog(ln, opts.backlog)
+}
+
+// systemdListener returns the socket with the name passed by systemd. An
+// empty name selects the only socket.
+func systemdListener(name string) (net.Listener, error) {
+	s := &systemdSockets
+	s.Lock()
+	defer s.Unlock()
+	if s.sockets == nil && s.err == nil {
+		s.sockets, s.err = activation.ListenersWithNames()
+	}
+	if s.err != nil {
+		return nil, fmt.Errorf("could not get sockets from systemd: %w", s.err)
+	}
+	if name == "" && len(s.sockets) == 1 {
+		for n := range s.sockets {
+			name = n
+		}
+	}
+	switch sockets := s.sockets[name]; len(sockets) {
+	case 0:
+		return nil, fmt.Errorf("systemd passed no socket named %q", name)
+	case 1:
+		delete(s.sockets, name)
+		return sockets[0], nil
+	default:
+		return nil, fmt.Errorf("systemd passed %d sockets named %q, use one socket unit per listener", len(sockets), name)
+	}
+}
+
+// serveOptions are the connection handling of a listener
+type serveOptions struct {
+	// proxyProtocol reads the PROXY header of connections before TLS
+	proxyProtocol bool
+	// limited counts the connections against the connection limit
+	limited bool
+}
+
+// serve listens on the address of the server and serves it in the
+// background, HTTPS if the server has a tls config. The process exits if
+// the address can not be used.
+func (app *application) serve(srv *http.Server, opts serveOptions) {
+	cfg := app.config()
+	ln, err := listen(srv.Addr, cfg.socketOptions)
+	if err != nil {
+		log.Fatalf("could not listen on %s: %v", srv.Addr, err)
+	}
+	ln = app.handoff.listener(ln)
+	if opts.limited {
+		ln = app.connections.listener(ln)
+		if l := app.clientConnections; l != nil {
+			srv.ConnContext, srv.ConnState = l.connContext, l.connState
+		}
+		srv.ConnState = app.countConnections(srv.ConnState)
+	}
+	srv.ConnState = app.handoff.connState(srv.ConnState)
+	if opts.proxyProtocol {
+		ln = proxyListener(ln, cfg.proxySources)
+	}
+	app.handoff.serving.Add(1)
+	go func() {
+		defer app.handoff.serving.Done()
+		var err error
+		if srv.TLSConfig != nil {
+			// the certificates are part of the tls config
+			err = srv.ServeTLS(ln, "", "")
+		} else {
+			err = srv.Serve(ln)
+		}
+		// the listeners are closed before the shutdown on upgrades
+		if err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
+			log.Error(err)
+		}
+	}()
+}
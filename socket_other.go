@@ -0,0 +1,24 @@
+//go:build !unix || solaris
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// reusePort fails as SO_REUSEPORT is not available on this platform
+func reusePort(_, _ string, _ syscall.RawConn) error {
+	return errors.New("reuse_port is not supported on this platform")
+}
+
+// withBacklog fails for a backlog other than Go's default, which cannot be
+// changed on this platform
+func withBacklog(ln net.Listener, backlog int) (net.Listener, error) {
+	if backlog == 0 {
+		return ln, nil
+	}
+	ln.Close()
+	return nil, errors.New("backlog is not supported on this platform")
+}
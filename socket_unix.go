@@ -0,0 +1,49 @@
+//go:build unix && !solaris
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// reusePort sets SO_REUSEPORT so several processes can listen on the same
+// port and the kernel distributes the connections between them
+func reusePort(_, _ string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// withBacklog changes the length of the queue of connections waiting to be
+// accepted by listening again, 0 keeps Go's default of net.core.somaxconn
+// which also caps the backlog.
+func withBacklog(ln net.Listener, backlog int) (net.Listener, error) {
+	if backlog == 0 {
+		return ln, nil
+	}
+	sc, ok := ln.(syscall.Conn)
+	if !ok {
+		return ln, nil
+	}
+	raw, err := sc.SyscallConn()
+	if err == nil {
+		if cerr := raw.Control(func(fd uintptr) {
+			err = unix.Listen(int(fd), backlog)
+		}); cerr != nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("could not set backlog: %w", err)
+	}
+	return ln, nil
+}
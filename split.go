@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// weightedTarget is one of several targets of a rule that splits traffic
+type weightedTarget struct {
+	Target string `yaml:"target,omitempty"`
+	Weight int    `yaml:"weight,omitempty"`
+}
+
+func validateWeightedTargets(targets []weightedTarget) error {
+	for _, t := range targets {
+		if t.Weight <= 0 {
+			return fmt.Errorf("target %q needs a positive weight", t.Target)
+		}
+		if err := validateTarget(t.Target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pickWeighted returns a target chosen by the weights. n must be in the
+// range [0, total weight).
+func pickWeighted(targets []weightedTarget, n int) string {
+	for _, t := range targets {
+		if n < t.Weight {
+			return t.Target
+		}
+		n -= t.Weight
+	}
+	return targets[len(targets)-1].Target
+}
+
+// canaryTarget receives a percentage of the traffic of a rule. The
+// percentage can be changed at runtime using the admin listener.
+type canaryTarget struct {
+	Target  string `yaml:"target,omitempty"`
+	Percent int    `yaml:"percent,omitempty"`
+
+	current atomic.Int32
+}
+
+func (c *canaryTarget) prepare() error {
+	if c.Percent < 0 || c.Percent > 100 {
+		return fmt.Errorf("canary percent must be between 0 and 100")
+	}
+	c.current.Store(int32(c.Percent))
+	return validateTarget(c.Target)
+}
+
+// setPercent changes the canary percentage and returns the previous value
+func (c *canaryTarget) setPercent(percent int) int {
+	return int(c.current.Swap(int32(percent)))
+}
+
+func (c *canaryTarget) status(id string) canaryStatus {
+	return canaryStatus{
+		ID:      id,
+		Target:  c.Target,
+		Percent: int(c.current.Load()),
+	}
+}
+
+const (
+	stickyNone         = ""
+	stickyIP           = "ip"
+	stickyCookiePrefix = "cookie:"
+)
+
+func validateSticky(sticky string) error {
+	switch {
+	case sticky == stickyNone, sticky == stickyIP:
+		return nil
+	case strings.HasPrefix(sticky, stickyCookiePrefix) && len(sticky) > len(stickyCookiePrefix):
+		return nil
+	}
+	return fmt.Errorf("invalid sticky mode %q", sticky)
+}
+
+// stickyKey returns the value identifying the visitor for sticky splits or
+// an empty string if there is none
+func stickyKey(sticky string, r *http.Request) string {
+	if sticky == stickyIP {
+		return clientIP(r)
+	}
+	if name, ok := strings.CutPrefix(sticky, stickyCookiePrefix); ok {
+		if c, err := r.Cookie(name); err == nil {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+// roll returns a number in the range [0, n). Sticky rules hash the visitor
+// together with the salt so the same visitor always gets the same number.
+func (ru *rule) roll(r *http.Request, salt string, n int) int {
+	if key := stickyKey(ru.Sticky, r); key != "" {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(ru.String()))
+		_, _ = h.Write([]byte(salt))
+		_, _ = h.Write([]byte(key))
+		return int(h.Sum64() % uint64(n))
+	}
+	return rand.IntN(n)
+}
+
+// selectTarget returns the unexpanded target for the request. This is the
+// canary target for the configured percentage of requests, otherwise the
+// target for the country or preferred language of the visitor or one of the
+// weighted targets if the rule splits traffic.
+func (ru *rule) selectTarget(r *http.Request) string {
+	if ru.Canary != nil && ru.roll(r, "canary", 100) < int(ru.Canary.current.Load()) {
+		return ru.Canary.Target
+	}
+	if target, ok := ru.countryTarget(r); ok && target != countryBlock {
+		return target
+	}
+	if target, ok := ru.languageTarget(r); ok {
+		return target
+	}
+	if len(ru.Targets) == 0 {
+		return ru.Target
+	}
+	return pickWeighted(ru.Targets, ru.roll(r, "", ru.totalWeight))
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "github.com/ncruces/go-sqlite3/driver"
+)
+
+// sqlDialect holds the parts of the schema and queries differing between
+// the databases, queries use ? as placeholder
+type sqlDialect struct {
+	driver string
+	// numbered uses $1, $2, ... instead of ? as placeholders
+	numbered bool
+	// migrations are applied in order, the version of the schema is the
+	// number of applied migrations
+	migrations []string
+	// order is the column sorting the rules in the order they were added
+	order      string
+	upsertRule string
+	addHits    string
+}
+
+var sqliteDialect = sqlDialect{
+	driver: "sqlite3",
+	migrations: []string{
+		`CREATE TABLE IF NOT EXISTS rules (
+			id TEXT PRIMARY KEY,
+			rule TEXT NOT NULL,
+			updated TIMESTAMP NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS hits (
+			rule TEXT PRIMARY KEY,
+			hits INTEGER NOT NULL,
+			last_hit TIMESTAMP NOT NULL
+		)`,
+		`CREATE TABLE clicks (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			rule TEXT NOT NULL,
+			time TIMESTAMP NOT NULL,
+			referer TEXT NOT NULL,
+			user_agent TEXT NOT NULL
+		);
+		CREATE INDEX clicks_rule_time ON clicks (rule, time)`,
+	},
+	order: "rowid",
+	upsertRule: `INSERT INTO rules (id, rule, updated) VALUES (?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET rule = excluded.rule, updated = excluded.updated`,
+	addHits: `INSERT INTO hits (rule, hits, last_hit) VALUES (?, ?, ?)
+		ON CONFLICT (rule) DO UPDATE SET hits = hits.hits + excluded.hits, last_hit = excluded.last_hit`,
+}
+
+var postgresDialect = sqlDialect{
+	driver:   "pgx",
+	numbered: true,
+	migrations: []string{
+		`CREATE TABLE rules (
+			seq BIGSERIAL NOT NULL,
+			id TEXT PRIMARY KEY,
+			rule TEXT NOT NULL,
+			updated TIMESTAMPTZ NOT NULL
+		);
+		CREATE TABLE hits (
+			rule TEXT PRIMARY KEY,
+			hits BIGINT NOT NULL,
+			last_hit TIMESTAMPTZ NOT NULL
+		)`,
+		`CREATE TABLE clicks (
+			id BIGSERIAL PRIMARY KEY,
+			rule TEXT NOT NULL,
+			time TIMESTAMPTZ NOT NULL,
+			referer TEXT NOT NULL,
+			user_agent TEXT NOT NULL
+		);
+		CREATE INDEX clicks_rule_time ON clicks (rule, time)`,
+	},
+	order: "seq",
+	upsertRule: `INSERT INTO rules (id, rule, updated) VALUES (?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET rule = excluded.rule, updated = excluded.updated`,
+	addHits: `INSERT INTO hits (rule, hits, last_hit) VALUES (?, ?, ?)
+		ON CONFLICT (rule) DO UPDATE SET hits = hits.hits + excluded.hits, last_hit = excluded.last_hit`,
+}
+
+// mysqlDialect commits the statements of migrations implicitly, a failed
+// migration may have to be cleaned up manually
+var mysqlDialect = sqlDialect{
+	driver: "mysql",
+	migrations: []string{
+		`CREATE TABLE rules (
+			seq BIGINT NOT NULL AUTO_INCREMENT UNIQUE,
+			id VARCHAR(255) PRIMARY KEY,
+			rule MEDIUMTEXT NOT NULL,
+			updated DATETIME(6) NOT NULL
+		);
+		CREATE TABLE hits (
+			rule VARCHAR(255) PRIMARY KEY,
+			hits BIGINT NOT NULL,
+			last_hit DATETIME(6) NOT NULL
+		)`,
+		`CREATE TABLE clicks (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			rule VARCHAR(255) NOT NULL,
+			time DATETIME(6) NOT NULL,
+			referer TEXT NOT NULL,
+			user_agent TEXT NOT NULL,
+			INDEX clicks_rule_time (rule, time)
+		)`,
+	},
+	order: "seq",
+	upsertRule: `INSERT INTO rules (id, rule, updated) VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE rule = VALUES(rule), updated = VALUES(updated)`,
+	addHits: `INSERT INTO hits (rule, hits, last_hit) VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE hits = hits + VALUES(hits), last_hit = VALUES(last_hit)`,
+}
+
+// sqlStore implements the storage in SQLite, PostgreSQL or MySQL
+type sqlStore struct {
+	db      *sql.DB
+	dialect sqlDialect
+}
+
+// openSQLStore connects to postgres:// and mysql:// URLs, everything else is
+// the filename of an SQLite database. The schema is migrated to the current
+// version.
+func openSQLStore(name string) (*sqlStore, error) {
+	dialect, dsn, err := storeDSN(name)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open(dialect.driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	s := &sqlStore{db: db, dialect: dialect}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not migrate: %w", err)
+	}
+	return s, nil
+}
+
+func storeDSN(name string) (sqlDialect, string, error) {
+	switch {
+	case strings.HasPrefix(name, "postgres://"), strings.HasPrefix(name, "postgresql://"):
+		return postgresDialect, name, nil
+	case strings.HasPrefix(name, "mysql://"):
+		u, err := url.Parse(name)
+		if err != nil {
+			return mysqlDialect, "", err
+		}
+		cfg := mysql.NewConfig()
+		cfg.Net = "tcp"
+		cfg.Addr = u.Host
+		cfg.User = u.User.Username()
+		cfg.Passwd, _ = u.User.Password()
+		cfg.DBName = strings.TrimPrefix(u.Path, "/")
+		cfg.ParseTime = true
+		cfg.Params = make(map[string]string)
+		for key, values := range u.Query() {
+			cfg.Params[key] = values[0]
+		}
+		return mysqlDialect, cfg.FormatDSN(), nil
+	}
+	// other configs can use the database while they are shut down after a
+	// reload, wait for their writes instead of failing
+	return sqliteDialect, "file:" + name + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(wal)", nil
+}
+
+// redactStore removes the password of database URLs for messages
+func redactStore(name string) string {
+	if u, err := url.Parse(name); err == nil && u.User != nil {
+		return u.Redacted()
+	}
+	return name
+}
+
+// query replaces the placeholders for databases with numbered placeholders
+func (s *sqlStore) query(q string) string {
+	if !s.dialect.numbered {
+		return q
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range q {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// migrate applies the migrations newer than the version of the schema.
+// Statements are executed one by one as not all drivers support multiple
+// statements in one call.
+func (s *sqlStore) migrate() error {
+	if _, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return err
+	}
+	var version int
+	if err := s.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return err
+	}
+	for i := version; i < len(s.dialect.migrations); i++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, stmt := range strings.Split(s.dialect.migrations[i], ";") {
+			if strings.TrimSpace(stmt) == "" {
+				continue
+			}
+			if _, err := tx.Exec(stmt); err != nil {
+				_ = tx.Rollback()
+				return fmt.Errorf("migration %d: %w", i+1, err)
+			}
+		}
+		if _, err := tx.Exec(s.query(`INSERT INTO schema_migrations (version) VALUES (?)`), i+1); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *sqlStore) listRules() ([]storedRule, error) {
+	rows, err := s.db.Query(`SELECT id, rule, updated FROM rules ORDER BY ` + s.dialect.order)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var stored []storedRule
+	for rows.Next() {
+		var sr storedRule
+		var value string
+		if err := rows.Scan(&sr.ID, &value, &sr.Updated); err != nil {
+			return nil, err
+		}
+		sr.Rule = json.RawMessage(value)
+		stored = append(stored, sr)
+	}
+	return stored, rows.Err()
+}
+
+func (s *sqlStore) putRule(id string, value json.RawMessage) (json.RawMessage, error) {
+	var old sql.NullString
+	err := s.db.QueryRow(s.query(`SELECT rule FROM rules WHERE id = ?`), id).Scan(&old)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	_, err = s.db.Exec(s.query(s.dialect.upsertRule), id, string(value), time.Now().UTC())
+	if err != nil || !old.Valid {
+		return nil, err
+	}
+	return json.RawMessage(old.String), nil
+}
+
+func (s *sqlStore) deleteRule(id string) (bool, error) {
+	res, err := s.db.Exec(s.query(`DELETE FROM rules WHERE id = ?`), id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *sqlStore) addHits(hits map[string]int64, clicks []click, at time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for key, n := range hits {
+		if _, err := tx.Exec(s.query(s.dialect.addHits), key, n, at); err != nil {
+			return err
+		}
+	}
+	for _, c := range clicks {
+		_, err := tx.Exec(s.query(`INSERT INTO clicks (rule, time, referer, user_agent) VALUES (?, ?, ?, ?)`),
+			c.rule, c.time, c.referer, c.userAgent)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) hitCounts() ([]hitCount, error) {
+	rows, err := s.db.Query(`SELECT rule, hits, last_hit FROM hits ORDER BY hits DESC, rule`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := []hitCount{}
+	for rows.Next() {
+		var c hitCount
+		if err := rows.Scan(&c.Rule, &c.Hits, &c.LastHit); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
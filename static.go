@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const robotsDisallowAll = "User-agent: *\nDisallow: /\n"
+
+// staticFile is served from memory instead of redirecting the request
+type staticFile struct {
+	path        string
+	contentType string
+	content     []byte
+}
+
+func (f staticFile) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", f.contentType)
+	_, _ = w.Write(f.content)
+}
+
+// readStaticFile reads the file to serve it as urlPath. The content type is
+// detected if it is empty.
+func readStaticFile(urlPath, contentType, filename string) (staticFile, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return staticFile{}, fmt.Errorf("could not read %s: %w", urlPath, err)
+	}
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(filename))
+	}
+	if contentType == "" {
+		contentType = http.DetectContentType(content)
+	}
+	return staticFile{path: urlPath, contentType: contentType, content: content}, nil
+}
+
+// readJSONFile reads a JSON file served as urlPath and makes sure it is
+// valid as clients silently ignore broken association files
+func readJSONFile(urlPath, filename string) (staticFile, error) {
+	f, err := readStaticFile(urlPath, "application/json", filename)
+	if err != nil {
+		return staticFile{}, err
+	}
+	if !json.Valid(f.content) {
+		return staticFile{}, fmt.Errorf("%s is not valid json", filename)
+	}
+	return f, nil
+}
+
+// appAssociationFiles returns the files allowing native apps to open links
+// on this domain
+func appAssociationFiles(appleFile, androidFile string) ([]staticFile, error) {
+	var files []staticFile
+	if appleFile != "" {
+		// older iOS versions request the file from the root
+		for _, p := range []string{"/.well-known/apple-app-site-association", "/apple-app-site-association"} {
+			f, err := readJSONFile(p, appleFile)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, f)
+		}
+	}
+	if androidFile != "" {
+		f, err := readJSONFile("/.well-known/assetlinks.json", androidFile)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// staticRoutes registers the locally served files on the router
+func (app *application) staticRoutes(r *mux.Router, cfg *config) {
+	for _, f := range cfg.staticFiles {
+		r.Handle(f.path, f).Methods(http.MethodGet, http.MethodHead)
+	}
+	if cfg.Files.FaviconNoContent {
+		r.HandleFunc("/favicon.ico", func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+	if cfg.Files.WellKnownDir != "" || cfg.Files.WellKnownExclude {
+		r.PathPrefix("/.well-known/").HandlerFunc(app.wellKnownHandler)
+	}
+}
+
+// wellKnownHandler serves files below /.well-known/ from the local
+// directory, e.g. security.txt or ACME challenges. Other requests are
+// redirected as usual unless .well-known is excluded from redirection.
+func (app *application) wellKnownHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := app.config()
+	if cfg.Files.WellKnownDir != "" && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		name := strings.TrimPrefix(r.URL.Path, "/.well-known")
+		// http.Dir prevents access outside of the directory
+		if f, err := http.Dir(cfg.Files.WellKnownDir).Open(name); err == nil {
+			defer f.Close()
+			if stat, err := f.Stat(); err == nil && !stat.IsDir() {
+				http.ServeContent(w, r, stat.Name(), stat.ModTime(), f)
+				return
+			}
+		}
+	}
+	if cfg.Files.WellKnownExclude {
+		app.errorPage(w, r, http.StatusNotFound)
+		return
+	}
+	app.catchAllHandler(w, r)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// reloadStats records the reloads of the config for the stats endpoint
+type reloadStats struct {
+	mu       sync.Mutex
+	count    int
+	failures int
+	last     time.Time
+	failed   time.Time
+	err      string
+}
+
+func (s *reloadStats) record(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.failures++
+		s.failed, s.err = time.Now(), err.Error()
+		return
+	}
+	s.count++
+	s.last = time.Now()
+}
+
+type runtimeStats struct {
+	Started       time.Time   `json:"started"`
+	UptimeSeconds int64       `json:"uptime_seconds"`
+	Goroutines    int         `json:"goroutines"`
+	Memory        memoryStats `json:"memory"`
+	Connections   int64       `json:"connections"`
+	Rules         int         `json:"rules"`
+	Maintenance   bool        `json:"maintenance"`
+	Reloads       int         `json:"reloads"`
+	LastReload    *time.Time  `json:"last_reload,omitempty"`
+	// ReloadFailures counts the rejected reloads, LastReloadError is the
+	// error of the last one
+	ReloadFailures    int        `json:"reload_failures"`
+	LastReloadFailure *time.Time `json:"last_reload_failure,omitempty"`
+	LastReloadError   string     `json:"last_reload_error,omitempty"`
+}
+
+// memoryStats are the bytes allocated by the process
+type memoryStats struct {
+	Alloc     uint64 `json:"alloc"`
+	HeapInuse uint64 `json:"heap_inuse"`
+	Sys       uint64 `json:"sys"`
+	GCRuns    uint32 `json:"gc_runs"`
+}
+
+// countConnections wraps the ConnState hook of a server to count its open
+// connections
+func (app *application) countConnections(next func(net.Conn, http.ConnState)) func(net.Conn, http.ConnState) {
+	return func(c net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			app.openConnections.Add(1)
+		case http.StateClosed, http.StateHijacked:
+			app.openConnections.Add(-1)
+		}
+		if next != nil {
+			next(c, state)
+		}
+	}
+}
+
+// statsHandler reports the state of the process for quick inspection
+func (app *application) statsHandler(w http.ResponseWriter, _ *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	stats := runtimeStats{
+		Started:       app.started,
+		UptimeSeconds: int64(time.Since(app.started).Seconds()),
+		Goroutines:    runtime.NumGoroutine(),
+		Memory: memoryStats{
+			Alloc:     mem.Alloc,
+			HeapInuse: mem.HeapInuse,
+			Sys:       mem.Sys,
+			GCRuns:    mem.NumGC,
+		},
+		Connections: app.openConnections.Load(),
+		Rules:       len(app.config().Rules),
+		Maintenance: app.maintenance.Load(),
+	}
+	r := &app.reloads
+	r.mu.Lock()
+	stats.Reloads, stats.ReloadFailures, stats.LastReloadError = r.count, r.failures, r.err
+	if !r.last.IsZero() {
+		last := r.last
+		stats.LastReload = &last
+	}
+	if !r.failed.IsZero() {
+		failed := r.failed
+		stats.LastReloadFailure = &failed
+	}
+	r.mu.Unlock()
+	app.writeJSON(w, http.StatusOK, stats)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/DataDog/datadog-go/v5/statsd"
+)
+
+type statsdConfig struct {
+	// Address of the StatsD or DogStatsD agent, e.g. 127.0.0.1:8125 or
+	// unix:///var/run/datadog/dsd.socket, disabled if empty
+	Address string `yaml:"address"`
+	// Prefix is prepended to the metric names
+	Prefix string `yaml:"prefix"`
+	// Tags are sent with every metric, e.g. env:prod
+	Tags []string `yaml:"tags"`
+}
+
+// newStatsd returns the client sending the metrics to the agent or nil if
+// no address is configured
+func (c statsdConfig) newStatsd() (statsd.ClientInterface, error) {
+	if c.Address == "" {
+		return nil, nil
+	}
+	return statsd.New(c.Address, statsd.WithNamespace(c.Prefix), statsd.WithTags(c.Tags))
+}
+
+// sendRequestMetrics counts the request and sends its duration to the
+// StatsD agent
+func (app *application) sendRequestMetrics(r *http.Request, code int, duration time.Duration) {
+	if app.statsd == nil {
+		return
+	}
+	listener := "listener:" + listenerName(r)
+	_ = app.statsd.Incr("http.requests", []string{listener, "code:" + strconv.Itoa(code), "method:" + r.Method}, 1)
+	_ = app.statsd.Timing("http.request.duration", duration, []string{listener, "class:" + statusClass(code)}, 1)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	logOutputSyslog = "syslog"
+	// syslogUDP and syslogTCP prefix the address of a remote syslog server
+	syslogUDP         = "syslog+udp://"
+	syslogTCP         = "syslog+tcp://"
+	defaultSyslogPort = "514"
+	// syslogQueueSize messages wait for a slow server, syslogTimeout limits
+	// connecting to it and writing a message
+	syslogQueueSize = 10000
+	syslogTimeout   = 5 * time.Second
+)
+
+type syslogConfig struct {
+	// Facility of the messages, e.g. daemon or local0
+	Facility string `yaml:"facility"`
+	// Tag is the name of the application in the messages
+	Tag string `yaml:"tag"`
+}
+
+// syslogPriority is the facility and severity of a message as defined by
+// RFC 5424, the facility is multiplied by 8
+type syslogPriority int
+
+const (
+	severityErr     syslogPriority = 3
+	severityWarning syslogPriority = 4
+	severityInfo    syslogPriority = 6
+	severityDebug   syslogPriority = 7
+)
+
+var syslogFacilities = map[string]syslogPriority{
+	"kern": 0 << 3, "user": 1 << 3, "mail": 2 << 3, "daemon": 3 << 3,
+	"auth": 4 << 3, "syslog": 5 << 3, "lpr": 6 << 3, "news": 7 << 3,
+	"uucp": 8 << 3, "cron": 9 << 3, "authpriv": 10 << 3, "ftp": 11 << 3,
+	"local0": 16 << 3, "local1": 17 << 3, "local2": 18 << 3, "local3": 19 << 3,
+	"local4": 20 << 3, "local5": 21 << 3, "local6": 22 << 3, "local7": 23 << 3,
+}
+
+func (c syslogConfig) validate() error {
+	if _, ok := syslogFacilities[c.Facility]; !ok {
+		return fmt.Errorf("invalid syslog facility %q", c.Facility)
+	}
+	if c.Tag == "" {
+		return fmt.Errorf("the syslog tag must not be empty")
+	}
+	return nil
+}
+
+// isSyslogOutput reports if the log output is a syslog server
+func isSyslogOutput(output string) bool {
+	return output == logOutputSyslog || strings.HasPrefix(output, syslogUDP) || strings.HasPrefix(output, syslogTCP)
+}
+
+// levelWriter is a log output keeping the level of the entries, the access
+// log is written with Write at level info
+type levelWriter interface {
+	writeLevel(level slog.Level, p []byte) error
+}
+
+// severity returns the syslog severity of a log level
+func severity(level slog.Level) syslogPriority {
+	switch {
+	case level >= slog.LevelError:
+		return severityErr
+	case level >= slog.LevelWarn:
+		return severityWarning
+	case level >= slog.LevelInfo:
+		return severityInfo
+	default:
+		return severityDebug
+	}
+}
+
+// openSyslog connects to the local syslog daemon or a remote server
+func (c syslogConfig) openSyslog(output string) (levelWriteCloser, error) {
+	facility := syslogFacilities[c.Facility]
+	if output == logOutputSyslog {
+		return openLocalSyslog(facility, c.Tag)
+	}
+	network, addr := "udp", strings.TrimPrefix(output, syslogUDP)
+	if strings.HasPrefix(output, syslogTCP) {
+		network, addr = "tcp", strings.TrimPrefix(output, syslogTCP)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, defaultSyslogPort)
+	}
+	hostname, _ := os.Hostname()
+	w := &remoteSyslog{
+		network: network, addr: addr, facility: facility, hostname: hostname, tag: c.Tag,
+		queue: make(chan []byte, syslogQueueSize),
+		done:  make(chan struct{}),
+	}
+	if err := w.connect(); err != nil {
+		return nil, err
+	}
+	go w.send()
+	return w, nil
+}
+
+type levelWriteCloser interface {
+	levelWriter
+	Write(p []byte) (int, error)
+	Close() error
+}
+
+// remoteSyslog sends RFC 5424 messages to a syslog server, over TCP they are
+// framed by octet counting as in RFC 6587. The messages are queued and sent
+// in the background, so a slow server can not block the requests writing
+// to the log. Messages not fitting in the queue are dropped and counted.
+type remoteSyslog struct {
+	network, addr string
+	facility      syslogPriority
+	hostname, tag string
+
+	// mu guards closed, the queue is closed once Close is called
+	mu      sync.RWMutex
+	closed  bool
+	queue   chan []byte
+	done    chan struct{}
+	dropped atomic.Int64
+	// conn is only used by send
+	conn net.Conn
+}
+
+func (w *remoteSyslog) connect() error {
+	conn, err := net.DialTimeout(w.network, w.addr, syslogTimeout)
+	if err != nil {
+		return fmt.Errorf("could not connect to syslog server %s: %w", w.addr, err)
+	}
+	w.conn = conn
+	return nil
+}
+
+func (w *remoteSyslog) Write(p []byte) (int, error) {
+	if err := w.writeLevel(slog.LevelInfo, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *remoteSyslog) writeLevel(level slog.Level, p []byte) error {
+	msg := w.format(w.facility|severity(level), strings.TrimSuffix(string(p), "\n"))
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		return nil
+	}
+	select {
+	case w.queue <- msg:
+	default:
+		w.dropped.Add(1)
+	}
+	return nil
+}
+
+func (w *remoteSyslog) format(priority syslogPriority, msg string) []byte {
+	line := fmt.Sprintf("<%d>1 %s %s %s %d - - %s", priority,
+		time.Now().Format("2006-01-02T15:04:05.000000Z07:00"), nilValue(w.hostname), w.tag, os.Getpid(), msg)
+	if w.network == "tcp" {
+		line = fmt.Sprintf("%d %s", len(line), line)
+	}
+	return []byte(line)
+}
+
+// send writes the queued messages to the server and reports the number of
+// dropped messages before the next one
+func (w *remoteSyslog) send() {
+	defer close(w.done)
+	for msg := range w.queue {
+		if n := w.dropped.Swap(0); n > 0 {
+			w.write(w.format(w.facility|severityWarning, fmt.Sprintf("dropped %d log messages, the syslog server was not reachable or too slow", n)))
+		}
+		w.write(msg)
+	}
+	if w.conn != nil {
+		_ = w.conn.Close()
+	}
+}
+
+// write sends the message within syslogTimeout, reconnecting once if the
+// server closed the connection. It is dropped if that fails.
+func (w *remoteSyslog) write(msg []byte) {
+	for range 2 {
+		if w.conn == nil {
+			if err := w.connect(); err != nil {
+				break
+			}
+		}
+		_ = w.conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+		if _, err := w.conn.Write(msg); err == nil {
+			return
+		}
+		_ = w.conn.Close()
+		w.conn = nil
+	}
+	w.dropped.Add(1)
+}
+
+// Close sends the queued messages, waiting at most syslogTimeout
+func (w *remoteSyslog) Close() error {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mu.Unlock()
+	select {
+	case <-w.done:
+	case <-time.After(syslogTimeout):
+	}
+	return nil
+}
+
+// nilValue returns the NILVALUE of RFC 5424 for empty fields
+func nilValue(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
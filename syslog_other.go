@@ -0,0 +1,11 @@
+//go:build windows || plan9
+
+package main
+
+import "errors"
+
+// openLocalSyslog fails as there is no local syslog daemon, remote syslog
+// servers are supported
+func openLocalSyslog(syslogPriority, string) (levelWriteCloser, error) {
+	return nil, errors.New("local syslog is not supported on this platform, use syslog+udp:// or syslog+tcp://")
+}
@@ -0,0 +1,38 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"log/syslog"
+	"strings"
+)
+
+// openLocalSyslog connects to the syslog daemon of the host
+func openLocalSyslog(facility syslogPriority, tag string) (levelWriteCloser, error) {
+	w, err := syslog.New(syslog.Priority(facility|severityInfo), tag)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to syslog: %w", err)
+	}
+	return localSyslog{w}, nil
+}
+
+// localSyslog writes to the syslog daemon of the host in its format
+type localSyslog struct {
+	*syslog.Writer
+}
+
+func (l localSyslog) writeLevel(level slog.Level, p []byte) error {
+	msg := strings.TrimSuffix(string(p), "\n")
+	switch severity(level) {
+	case severityErr:
+		return l.Err(msg)
+	case severityWarning:
+		return l.Warning(msg)
+	case severityInfo:
+		return l.Info(msg)
+	default:
+		return l.Debug(msg)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var placeholderRegex = regexp.MustCompile(`\{(path|query|host|scheme|header:[^}]+)\}`)
+
+// expandPlaceholders replaces {path}, {query}, {host}, {scheme} and
+// {header:Name} in the target with the values of the current request
+func expandPlaceholders(target string, r *http.Request) string {
+	if !strings.Contains(target, "{") {
+		return target
+	}
+	return placeholderRegex.ReplaceAllStringFunc(target, func(m string) string {
+		name := m[1 : len(m)-1]
+		switch name {
+		case "path":
+			return r.URL.EscapedPath()
+		case "query":
+			return r.URL.RawQuery
+		case "host":
+			return requestHost(r)
+		case "scheme":
+			return requestScheme(r)
+		}
+		header := strings.TrimPrefix(name, "header:")
+		return url.QueryEscape(r.Header.Get(header))
+	})
+}
+
+// validateTarget checks if the target is a valid URL once all placeholders
+// are expanded
+func validateTarget(target string) error {
+	if _, err := url.Parse(placeholderRegex.ReplaceAllString(target, "x")); err != nil {
+		return fmt.Errorf("invalid target %q: %w", target, err)
+	}
+	return nil
+}
+
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// buildTarget returns the final redirect location for the request, expanding
+// placeholders, carrying over the request path and query string if enabled
+// and applying the query transformations of the matched rule. ru is nil if
+// no rule matched.
+func (cfg *config) buildTarget(target string, r *http.Request, ru *rule) (string, error) {
+	target = expandPlaceholders(target, r)
+	// regex rules build the complete target path themselves
+	keepPath := cfg.PreservePath && (ru == nil || ru.re == nil)
+	var query *queryRules
+	if ru != nil {
+		query = ru.Query
+	}
+	if !keepPath && !cfg.PreserveQuery && query == nil {
+		return target, nil
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", fmt.Errorf("invalid target %q: %w", target, err)
+	}
+
+	if keepPath {
+		u.Path = strings.TrimSuffix(u.Path, "/") + r.URL.Path
+		u.RawPath = ""
+	}
+
+	if cfg.PreserveQuery && r.URL.RawQuery != "" {
+		if u.RawQuery == "" {
+			u.RawQuery = r.URL.RawQuery
+		} else {
+			u.RawQuery = u.RawQuery + "&" + r.URL.RawQuery
+		}
+	}
+
+	if query != nil {
+		u.RawQuery = query.apply(u.Query()).Encode()
+	}
+
+	return u.String(), nil
+}
+
+// queryRules describes the query parameter transformations of a rule. They
+// are applied in the order rename, strip, add.
+type queryRules struct {
+	Strip  []string          `yaml:"strip,omitempty"`
+	Add    map[string]string `yaml:"add,omitempty"`
+	Rename map[string]string `yaml:"rename,omitempty"`
+}
+
+func (q *queryRules) apply(values url.Values) url.Values {
+	for from, to := range q.Rename {
+		if v, ok := values[from]; ok {
+			delete(values, from)
+			values[to] = append(values[to], v...)
+		}
+	}
+	for _, name := range q.Strip {
+		values.Del(name)
+	}
+	for name, value := range q.Add {
+		values.Set(name, value)
+	}
+	return values
+}
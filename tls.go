@@ -0,0 +1,460 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+type tlsConfig struct {
+	// Cert and Key are PEM files, the certificate file can contain the
+	// chain
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// Certificates are further certificates selected by the server name
+	// of the client, Cert is used if no certificate matches
+	Certificates []certificateFiles `yaml:"certificates"`
+	ACME         acmeConfig         `yaml:"acme"`
+	// MinVersion is 1.0, 1.1, 1.2 or 1.3, the default of Go (1.2) if empty
+	MinVersion string `yaml:"min_version"`
+	// Ciphers are the names of the allowed TLS 1.2 cipher suites, TLS 1.3
+	// suites are not configurable
+	Ciphers []string `yaml:"ciphers"`
+	// Curves are the key exchanges in order of preference
+	Curves []string `yaml:"curves"`
+	// ClientCA is a PEM file with the CAs client certificates are required
+	// to be signed by
+	ClientCA string `yaml:"client_ca"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519":         tls.X25519,
+	"X25519MLKEM768": tls.X25519MLKEM768,
+	"P256":           tls.CurveP256,
+	"P384":           tls.CurveP384,
+	"P521":           tls.CurveP521,
+}
+
+// tlsParameters are the parsed protocol settings of the listener
+type tlsParameters struct {
+	minVersion uint16
+	ciphers    []uint16
+	curves     []tls.CurveID
+	clientCAs  *x509.CertPool
+}
+
+type certificateFiles struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+}
+
+// acmeConfig obtains and renews certificates from Let's Encrypt or another
+// ACME CA instead of using a certificate file
+type acmeConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Hosts are the only names certificates are requested for
+	Hosts []string `yaml:"hosts"`
+	// Cache is the directory keeping the account key and certificates
+	Cache string `yaml:"cache"`
+	Email string `yaml:"email"`
+	// HTTP is the address of the listener answering HTTP-01 challenges,
+	// other requests are redirected like on the TLS listener. Only
+	// TLS-ALPN-01 is used if empty.
+	HTTP string `yaml:"http"`
+	// DirectoryURL of the CA, Let's Encrypt if empty
+	DirectoryURL string `yaml:"directory_url"`
+	// DNSProvider solves DNS-01 challenges instead, which allows wildcard
+	// hosts. One of cloudflare, route53 and rfc2136.
+	DNSProvider string `yaml:"dns_provider"`
+}
+
+// files returns the certificate files, the default certificate first
+func (c tlsConfig) files() []certificateFiles {
+	var files []certificateFiles
+	if c.Cert != "" || c.Key != "" {
+		files = append(files, certificateFiles{Cert: c.Cert, Key: c.Key})
+	}
+	return append(files, c.Certificates...)
+}
+
+func (c tlsConfig) enabled() bool {
+	return len(c.files()) > 0 || c.ACME.Enabled
+}
+
+// listener returns the settings applied when the listener starts, without
+// the certificate files which are reloaded at runtime
+func (c tlsConfig) listener() tlsConfig {
+	c.Cert, c.Key, c.Certificates = "", "", nil
+	return c
+}
+
+// parameters parses the version, cipher suites and curves. Only the secure
+// cipher suites of Go are accepted.
+func (c tlsConfig) parameters() (tlsParameters, error) {
+	var p tlsParameters
+	if c.MinVersion != "" {
+		v, ok := tlsVersions[c.MinVersion]
+		if !ok {
+			return p, fmt.Errorf("invalid tls min version %q, possible values are 1.0, 1.1, 1.2 and 1.3", c.MinVersion)
+		}
+		p.minVersion = v
+	}
+	suites := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = suite.ID
+	}
+	for _, name := range c.Ciphers {
+		id, ok := suites[strings.TrimSpace(name)]
+		if !ok {
+			return p, fmt.Errorf("unknown or insecure tls cipher suite %q", name)
+		}
+		p.ciphers = append(p.ciphers, id)
+	}
+	if len(p.ciphers) > 0 && !slices.Contains(p.ciphers, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256) &&
+		!slices.Contains(p.ciphers, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256) {
+		return p, fmt.Errorf("tls cipher suites must contain TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 as required by HTTP/2")
+	}
+	for _, name := range c.Curves {
+		id, ok := tlsCurves[strings.TrimSpace(name)]
+		if !ok {
+			return p, fmt.Errorf("unknown tls curve %q, possible values are X25519, X25519MLKEM768, P256, P384 and P521", name)
+		}
+		p.curves = append(p.curves, id)
+	}
+	if c.ClientCA != "" {
+		if c.ACME.Enabled && c.ACME.DNSProvider == "" && c.ACME.HTTP == "" {
+			return p, fmt.Errorf("tls client certificates can not be required with TLS-ALPN-01 challenges, use an acme http listener or dns provider")
+		}
+		data, err := os.ReadFile(c.ClientCA)
+		if err != nil {
+			return p, fmt.Errorf("could not read tls client ca: %w", err)
+		}
+		p.clientCAs = x509.NewCertPool()
+		if !p.clientCAs.AppendCertsFromPEM(data) {
+			return p, fmt.Errorf("no certificates found in tls client ca %s", c.ClientCA)
+		}
+	}
+	return p, nil
+}
+
+func (p tlsParameters) apply(c *tls.Config) *tls.Config {
+	if p.minVersion != 0 {
+		c.MinVersion = p.minVersion
+	}
+	if len(p.ciphers) > 0 {
+		c.CipherSuites = p.ciphers
+	}
+	if len(p.curves) > 0 {
+		c.CurvePreferences = p.curves
+	}
+	if p.clientCAs != nil {
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+		c.ClientCAs = p.clientCAs
+	}
+	return c
+}
+
+// loadTLS loads the certificates of the listener or sets up the ACME client
+func (cfg *config) loadTLS() error {
+	if redirect := cfg.Listen.HTTPSRedirect; redirect != "" {
+		if !cfg.TLS.enabled() {
+			return fmt.Errorf("the https redirect listener requires tls")
+		}
+		if redirect == cfg.Listen.Address || redirect == cfg.TLS.ACME.HTTP {
+			return fmt.Errorf("the https redirect listener needs its own address")
+		}
+	}
+	if cfg.Listen.H2C && cfg.TLS.enabled() {
+		return fmt.Errorf("h2c is only available without tls, tls listeners negotiate HTTP/2")
+	}
+	if cfg.Listen.HTTP3 && !cfg.TLS.enabled() {
+		return fmt.Errorf("http3 requires tls")
+	}
+	if cfg.Listen.HTTP3 && (strings.HasPrefix(cfg.Listen.Address, unixPrefix) || strings.HasPrefix(cfg.Listen.Address, systemdPrefix)) {
+		return fmt.Errorf("http3 requires an udp port, not a unix domain or systemd socket")
+	}
+	if !cfg.TLS.enabled() {
+		return nil
+	}
+	params, err := cfg.TLS.parameters()
+	if err != nil {
+		return err
+	}
+	cfg.tlsParameters = params
+	if cfg.TLS.ACME.Enabled {
+		if len(cfg.TLS.files()) > 0 {
+			return fmt.Errorf("tls certificate files and acme can not be used together")
+		}
+		return cfg.setupACME()
+	}
+	return nil
+}
+
+// certificateFiles returns the certificate files of the listeners by their
+// name, the main listener is named ""
+func (cfg *config) certificateFiles() map[string][]certificateFiles {
+	files := make(map[string][]certificateFiles)
+	if !cfg.TLS.ACME.Enabled && len(cfg.TLS.files()) > 0 {
+		files[""] = cfg.TLS.files()
+	}
+	for _, l := range cfg.Listeners {
+		if len(l.TLS.files()) > 0 {
+			files[l.Name] = l.TLS.files()
+		}
+	}
+	return files
+}
+
+func loadCertificateSets(files map[string][]certificateFiles) (map[string][]tls.Certificate, error) {
+	sets := make(map[string][]tls.Certificate, len(files))
+	for name, f := range files {
+		certs, err := loadCertificates(f)
+		if err != nil {
+			return nil, err
+		}
+		sets[name] = certs
+	}
+	return sets, nil
+}
+
+func loadCertificates(files []certificateFiles) ([]tls.Certificate, error) {
+	certs := make([]tls.Certificate, 0, len(files))
+	for _, f := range files {
+		if f.Cert == "" || f.Key == "" {
+			return nil, fmt.Errorf("tls requires a certificate and a key")
+		}
+		cert, err := tls.LoadX509KeyPair(f.Cert, f.Key)
+		if err != nil {
+			return nil, fmt.Errorf("could not load tls certificate %s: %w", f.Cert, err)
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// selectCertificate returns the first certificate valid for the server name
+// the client asked for, or the first certificate if none matches
+func selectCertificate(certs []tls.Certificate, hello *tls.ClientHelloInfo) *tls.Certificate {
+	for i := range certs {
+		if hello.SupportsCertificate(&certs[i]) == nil {
+			return &certs[i]
+		}
+	}
+	return &certs[0]
+}
+
+func (cfg *config) setupACME() error {
+	c := cfg.TLS.ACME
+	var hosts []string
+	for _, h := range c.Hosts {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	// without an allowlist any client could make us request certificates
+	// for arbitrary names and run into the rate limits of the CA
+	if len(hosts) == 0 {
+		return fmt.Errorf("acme requires at least one host")
+	}
+	if c.Cache == "" {
+		return fmt.Errorf("acme requires a cache directory")
+	}
+	if c.DNSProvider != "" {
+		if c.HTTP != "" {
+			return fmt.Errorf("the acme http listener is not used with a dns provider")
+		}
+		issuer, err := newDNSIssuer(c, hosts)
+		if err != nil {
+			return fmt.Errorf("could not set up acme dns challenges: %w", err)
+		}
+		cfg.acmeDNS = issuer
+		return nil
+	}
+	for _, h := range hosts {
+		if strings.HasPrefix(h, "*.") {
+			return fmt.Errorf("wildcard host %s requires an acme dns provider", h)
+		}
+	}
+	cfg.acme = &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(c.Cache),
+		HostPolicy: autocert.HostWhitelist(hosts...),
+		Email:      c.Email,
+	}
+	if c.DirectoryURL != "" {
+		cfg.acme.Client = &acme.Client{DirectoryURL: c.DirectoryURL}
+	}
+	return nil
+}
+
+// serverTLSConfig returns the tls config of the main listener
+func (app *application) serverTLSConfig(cfg *config) *tls.Config {
+	if cfg.acmeDNS != nil {
+		return cfg.tlsParameters.apply(&tls.Config{GetCertificate: cfg.acmeDNS.getCertificate})
+	}
+	if cfg.acme != nil {
+		// includes the protocol of TLS-ALPN-01 challenges
+		return cfg.tlsParameters.apply(cfg.acme.TLSConfig())
+	}
+	return app.certificateTLSConfig("", cfg.tlsParameters)
+}
+
+// certificateTLSConfig returns the tls config of a listener using
+// certificate files. They are served from app.certificates, so reloads
+// replace them for new connections.
+func (app *application) certificateTLSConfig(name string, params tlsParameters) *tls.Config {
+	return params.apply(&tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			certs := (*app.certificates.Load())[name]
+			if len(certs) == 0 {
+				return nil, fmt.Errorf("no certificate for listener %q", name)
+			}
+			return selectCertificate(certs, hello), nil
+		},
+	})
+}
+
+// storeCertificates replaces the certificates of the listeners. Listeners
+// missing in certs keep theirs, they are still running until a restart.
+func (app *application) storeCertificates(certs map[string][]tls.Certificate) {
+	sets := make(map[string][]tls.Certificate)
+	if current := app.certificates.Load(); current != nil {
+		maps.Copy(sets, *current)
+	}
+	maps.Copy(sets, certs)
+	app.certificates.Store(&sets)
+}
+
+// watchCertificate reloads the certificate files of the active config when
+// they change, e.g. when they are renewed by cert-manager or an ACME client.
+// The old certificate is kept if the files are invalid.
+func (app *application) watchCertificate(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	patterns := app.watchCertificateFiles(watcher)
+	reload := time.NewTimer(reloadDebounce)
+	reload.Stop()
+	defer reload.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if watched(patterns, event.Name) {
+				tlsLog.Debugf("certificate change detected: %s", event)
+				reload.Reset(reloadDebounce)
+			}
+		case <-reload.C:
+			if files := app.config().certificateFiles(); len(files) > 0 {
+				certs, err := loadCertificateSets(files)
+				if err != nil {
+					tlsLog.Errorf("could not reload tls certificates, keeping the current ones: %v", err)
+				} else {
+					app.storeCertificates(certs)
+					tlsLog.Infof("tls certificates of %d listeners reloaded", len(certs))
+				}
+			}
+			// a reload of the config may have changed the files
+			patterns = app.watchCertificateFiles(watcher)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			tlsLog.Errorf("certificate watcher: %v", err)
+		}
+	}
+}
+
+// watchCertificateFiles adds the directories of the certificate files to the
+// watcher and returns the patterns matching the files
+func (app *application) watchCertificateFiles(watcher *fsnotify.Watcher) []string {
+	var patterns []string
+	for _, pair := range slices.Concat(slices.Collect(maps.Values(app.config().certificateFiles()))...) {
+		for _, f := range []string{pair.Cert, pair.Key} {
+			if f == "" {
+				continue
+			}
+			if err := watcher.Add(filepath.Dir(f)); err != nil {
+				tlsLog.Errorf("could not watch %s: %v", f, err)
+				continue
+			}
+			patterns = append(patterns, filepath.Clean(f))
+		}
+	}
+	return patterns
+}
+
+// serverProtocols returns the protocols of the listener, HTTP/2 is
+// negotiated with TLS or accepted with prior knowledge when h2c is enabled
+func serverProtocols(cfg *config) *http.Protocols {
+	p := new(http.Protocols)
+	p.SetHTTP1(true)
+	if cfg.TLS.enabled() {
+		p.SetHTTP2(true)
+	}
+	p.SetUnencryptedHTTP2(cfg.Listen.H2C)
+	return p
+}
+
+// httpsRedirect redirects every request to the same URL on the TLS listener.
+// GET and HEAD are redirected permanently with 301, other methods with 308
+// so they are repeated with their body.
+func httpsRedirect(tlsAddress string) http.Handler {
+	port := ""
+	if _, p, err := net.SplitHostPort(tlsAddress); err == nil && p != "443" {
+		port = p
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := requestHost(r)
+		if host == "" {
+			http.Error(w, "missing host", http.StatusBadRequest)
+			return
+		}
+		if port != "" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		u := url.URL{
+			Scheme:   "https",
+			Host:     host,
+			Path:     r.URL.Path,
+			RawPath:  r.URL.RawPath,
+			RawQuery: r.URL.RawQuery,
+		}
+		status := http.StatusPermanentRedirect
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			status = http.StatusMovedPermanently
+		}
+		http.Redirect(w, r, u.String(), status)
+	})
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// upgradeEnv passes the sockets and the readiness pipe to the new
+	// process of an upgrade
+	upgradeEnv = "REDIRECTOR_UPGRADE_FDS"
+	// upgradeTimeout is the time the new process gets to listen on all
+	// addresses
+	upgradeTimeout = time.Minute
+	// udpPrefix marks the UDP sockets of HTTP/3 in the sockets passed on
+	// upgrades
+	udpPrefix = "udp:"
+)
+
+// handoff tracks the listeners and the new connections of the servers, so
+// an upgrade can pass them to the new process without dropping requests
+type handoff struct {
+	serving   sync.WaitGroup
+	mu        sync.Mutex
+	listeners []*closeOnceListener
+	fresh     map[net.Conn]bool
+}
+
+// closeOnceListener ignores further calls of Close, servers close their
+// listeners again on shutdown
+type closeOnceListener struct {
+	net.Listener
+	once sync.Once
+	err  error
+}
+
+func (l *closeOnceListener) Close() error {
+	l.once.Do(func() { l.err = l.Listener.Close() })
+	return l.err
+}
+
+// listener returns the listener closed by handOver
+func (h *handoff) listener(ln net.Listener) net.Listener {
+	l := &closeOnceListener{Listener: ln}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.listeners = append(h.listeners, l)
+	return l
+}
+
+// connState wraps the ConnState hook of a server to track connections
+// whose first request has not been read yet
+func (h *handoff) connState(next func(net.Conn, http.ConnState)) func(net.Conn, http.ConnState) {
+	return func(c net.Conn, state http.ConnState) {
+		h.mu.Lock()
+		if state == http.StateNew {
+			if h.fresh == nil {
+				h.fresh = make(map[net.Conn]bool)
+			}
+			h.fresh[c] = true
+		} else {
+			delete(h.fresh, c)
+		}
+		h.mu.Unlock()
+		if next != nil {
+			next(c, state)
+		}
+	}
+}
+
+// handOver stops accepting connections, which are accepted by the new
+// process from now on, and waits until the first request of the accepted
+// connections has been read. A server shutting down closes connections
+// instead of answering their first request.
+func (h *handoff) handOver(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	h.mu.Lock()
+	for _, l := range h.listeners {
+		l.Close()
+	}
+	h.mu.Unlock()
+	stopped := make(chan struct{})
+	go func() {
+		h.serving.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		return
+	}
+	for time.Now().Before(deadline) {
+		h.mu.Lock()
+		fresh := len(h.fresh)
+		h.mu.Unlock()
+		if fresh == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// upgradeState is the content of upgradeEnv, the file descriptors of the
+// sockets by their address and of the pipe reporting readiness
+type upgradeState struct {
+	Sockets map[string]int `json:"sockets"`
+	Ready   int            `json:"ready"`
+}
+
+// sockets are the listening sockets of this process by their address,
+// passed to the new process on upgrades
+var sockets = struct {
+	sync.Mutex
+	open map[string]fileSocket
+}{open: make(map[string]fileSocket)}
+
+// fileSocket is a socket whose file descriptor can be passed on
+type fileSocket interface {
+	SyscallConn() (syscall.RawConn, error)
+}
+
+// inherited are the sockets passed by the previous process of an upgrade,
+// they are taken out once a listener uses them
+var inherited = struct {
+	sync.Mutex
+	loaded  bool
+	sockets map[string]*os.File
+	ready   *os.File
+}{}
+
+// keepSocket remembers the socket of the address for upgrades
+func keepSocket(address string, s fileSocket) {
+	sockets.Lock()
+	defer sockets.Unlock()
+	sockets.open[address] = s
+}
+
+// loadInherited reads the sockets passed by the previous process, the
+// variable is removed so it is not passed on to processes started later
+func loadInherited() {
+	if inherited.loaded {
+		return
+	}
+	inherited.loaded = true
+	value, ok := os.LookupEnv(upgradeEnv)
+	if !ok {
+		return
+	}
+	os.Unsetenv(upgradeEnv)
+	var state upgradeState
+	if err := json.Unmarshal([]byte(value), &state); err != nil {
+		upgradeLog.Errorf("invalid %s: %v", upgradeEnv, err)
+		return
+	}
+	inherited.sockets = make(map[string]*os.File)
+	for address, fd := range state.Sockets {
+		inherited.sockets[address] = os.NewFile(uintptr(fd), address)
+	}
+	inherited.ready = os.NewFile(uintptr(state.Ready), "upgrade")
+}
+
+// inheritedFile returns the socket of the address passed by the previous
+// process or nil
+func inheritedFile(address string) *os.File {
+	inherited.Lock()
+	defer inherited.Unlock()
+	loadInherited()
+	f := inherited.sockets[address]
+	delete(inherited.sockets, address)
+	return f
+}
+
+// inheritedListener returns the listener of the address passed by the
+// previous process or nil
+func inheritedListener(address string) (net.Listener, error) {
+	f := inheritedFile(address)
+	if f == nil {
+		return nil, nil
+	}
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("could not use inherited socket: %w", err)
+	}
+	if ul, ok := ln.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(true)
+	}
+	return ln, nil
+}
+
+// listenPacket opens the UDP socket of HTTP/3 or uses the one passed by the
+// previous process
+func listenPacket(address string) (net.PacketConn, error) {
+	key := udpPrefix + address
+	var conn net.PacketConn
+	if f := inheritedFile(key); f != nil {
+		defer f.Close()
+		c, err := net.FilePacketConn(f)
+		if err != nil {
+			return nil, fmt.Errorf("could not use inherited socket: %w", err)
+		}
+		conn = c
+	} else {
+		c, err := net.ListenPacket("udp", address)
+		if err != nil {
+			return nil, err
+		}
+		conn = c
+	}
+	if s, ok := conn.(fileSocket); ok {
+		keepSocket(key, s)
+	}
+	return conn, nil
+}
+
+// upgradeReady tells the previous process that all listeners are running,
+// so it can shut down. Sockets of removed listeners are closed.
+func upgradeReady() {
+	inherited.Lock()
+	defer inherited.Unlock()
+	loadInherited()
+	for address, f := range inherited.sockets {
+		upgradeLog.Infof("closing inherited socket of %s, it is no longer configured", address)
+		f.Close()
+	}
+	inherited.sockets = nil
+	if inherited.ready == nil {
+		return
+	}
+	if _, err := inherited.ready.Write([]byte{1}); err != nil {
+		upgradeLog.Errorf("could not report upgrade: %v", err)
+	}
+	inherited.ready.Close()
+	inherited.ready = nil
+}
@@ -0,0 +1,7 @@
+//go:build !unix
+
+package main
+
+// upgradeOnSignal does nothing as handing the sockets over to a new
+// process needs fork and exec of unix systems
+func (app *application) upgradeOnSignal(chan<- struct{}) {}
@@ -0,0 +1,128 @@
+//go:build unix
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// upgradeOnSignal starts the current binary on every SIGUSR2 and sends on
+// upgraded once it took over the listeners
+func (app *application) upgradeOnSignal(upgraded chan<- struct{}) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR2)
+	for range c {
+		if err := app.upgrade(); err != nil {
+			upgradeLog.Errorf("upgrade failed, keeping the current process: %v", err)
+			continue
+		}
+		upgraded <- struct{}{}
+		return
+	}
+}
+
+// upgrade starts the binary with the same arguments passing the listening
+// sockets, and waits until it listens on all addresses
+func (app *application) upgrade() error {
+	app.reloadMu.Lock()
+	defer app.reloadMu.Unlock()
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+
+	// the descriptors are passed as they are, os/exec would switch the
+	// shared sockets to blocking mode which keeps Close from interrupting
+	// Accept. 0 to 2 are stdin, stdout and stderr.
+	state := upgradeState{Sockets: make(map[string]int)}
+	fds := []uintptr{0, 1, 2}
+	sockets.Lock()
+	for address, s := range sockets.open {
+		raw, err := s.SyscallConn()
+		if err == nil {
+			err = raw.Control(func(fd uintptr) {
+				state.Sockets[address] = len(fds)
+				fds = append(fds, fd)
+			})
+		}
+		if err != nil {
+			sockets.Unlock()
+			readyW.Close()
+			return fmt.Errorf("could not pass socket of %s: %w", address, err)
+		}
+	}
+	state.Ready = len(fds)
+	fds = append(fds, readyW.Fd())
+	encoded, err := json.Marshal(state)
+	if err != nil {
+		sockets.Unlock()
+		readyW.Close()
+		return err
+	}
+
+	var env []string
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, upgradeEnv+"=") {
+			env = append(env, e)
+		}
+	}
+	env = append(env, upgradeEnv+"="+string(encoded))
+	upgradeLog.Infof("upgrading, starting %s", exe)
+	pid, err := syscall.ForkExec(exe, os.Args, &syscall.ProcAttr{Env: env, Files: fds})
+	sockets.Unlock()
+	// only the new process keeps the write end, so reading ends if it exits
+	readyW.Close()
+	if err != nil {
+		return err
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := ready.Read(make([]byte, 1))
+		if errors.Is(err, io.EOF) {
+			err = errors.New("the new process exited before listening on all addresses")
+		}
+		result <- err
+	}()
+	select {
+	case err = <-result:
+	case <-time.After(upgradeTimeout):
+		err = fmt.Errorf("the new process did not listen on all addresses within %s", upgradeTimeout)
+	}
+	if err != nil {
+		_ = process.Kill()
+		_, _ = process.Wait()
+		return err
+	}
+
+	// the new process uses the same paths, they must stay when the sockets
+	// of this process are closed
+	sockets.Lock()
+	for _, s := range sockets.open {
+		if ul, ok := s.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	sockets.Unlock()
+	upgradeLog.Infof("upgrade done, process %d took over the listeners", pid)
+	return nil
+}
@@ -0,0 +1,30 @@
+package main
+
+// validate checks the config built from the arguments like on startup,
+// including all rules and referenced files, without binding any ports or
+// opening the store, Redis and the GeoIP database. It returns the exit code.
+func validate(args []string) int {
+	cfg, err := parseConfig(args)
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+	if err := cfg.check(); err != nil {
+		log.Error(err)
+		return 1
+	}
+	defer cfg.close()
+	if cfg.Git.Repository != "" {
+		log.Warnf("git repository %s is not synced, the checkout in %s is validated", cfg.Git.Repository, cfg.Git.Directory)
+	}
+	if err := cfg.prepareRules(); err != nil {
+		log.Error(err)
+		return 1
+	}
+	if cfg.Store != "" {
+		log.Infof("config is valid, %d rules, the rules in the store are not validated", len(cfg.Rules))
+		return 0
+	}
+	log.Infof("config is valid, %d rules", len(cfg.Rules))
+	return 0
+}
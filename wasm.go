@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+const wasmTimeout = time.Second
+
+// pluginRequest is passed as JSON to WASM plugins
+type pluginRequest struct {
+	Path      string            `json:"path"`
+	Query     string            `json:"query"`
+	Host      string            `json:"host"`
+	Method    string            `json:"method"`
+	Scheme    string            `json:"scheme"`
+	ClientIP  string            `json:"client_ip"`
+	UserAgent string            `json:"user_agent"`
+	Headers   map[string]string `json:"headers"`
+}
+
+// pluginResponse is returned as JSON by WASM plugins
+type pluginResponse struct {
+	Target string `json:"target"`
+	Status int    `json:"status"`
+}
+
+// wasmPlugin decides redirects using a WASM module. The module has to
+// export its memory, alloc(size i32) i32 and redirect(ptr i32, len i32) i64.
+// redirect receives the JSON encoded pluginRequest and returns the pointer
+// to the JSON encoded pluginResponse in the upper and its length in the
+// lower 32 bits, a length of 0 hands the request over to the rules. The
+// module owns its memory, an exported dealloc(ptr i32, len i32) is called
+// for the request buffer if present. WASI is available.
+type wasmPlugin struct {
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	pool     sync.Pool
+}
+
+func loadWASMPlugin(filename string) (*wasmPlugin, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not read wasm plugin: %w", err)
+	}
+	ctx := context.Background()
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true))
+	wasi_snapshot_preview1.MustInstantiate(ctx, runtime)
+	compiled, err := runtime.CompileModule(ctx, content)
+	if err != nil {
+		_ = runtime.Close(ctx)
+		return nil, fmt.Errorf("could not compile wasm plugin: %w", err)
+	}
+	for _, name := range []string{"alloc", "redirect"} {
+		if _, ok := compiled.ExportedFunctions()[name]; !ok {
+			_ = runtime.Close(ctx)
+			return nil, fmt.Errorf("wasm plugin does not export %s", name)
+		}
+	}
+	p := &wasmPlugin{runtime: runtime, compiled: compiled}
+	// make sure the module can be instantiated before serving
+	mod, err := p.instantiate(ctx)
+	if err != nil {
+		_ = runtime.Close(ctx)
+		return nil, err
+	}
+	p.pool.Put(mod)
+	return p, nil
+}
+
+func (p *wasmPlugin) Close() error {
+	return p.runtime.Close(context.Background())
+}
+
+func (p *wasmPlugin) instantiate(ctx context.Context) (api.Module, error) {
+	// anonymous modules can be instantiated multiple times, reactor modules
+	// are initialized with _initialize instead of running _start
+	cfg := wazero.NewModuleConfig().WithName("").WithStartFunctions("_initialize")
+	mod, err := p.runtime.InstantiateModule(ctx, p.compiled, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("could not instantiate wasm plugin: %w", err)
+	}
+	return mod, nil
+}
+
+func newPluginRequest(r *http.Request) pluginRequest {
+	headers := make(map[string]string, len(r.Header))
+	for name, values := range r.Header {
+		headers[strings.ToLower(name)] = strings.Join(values, ", ")
+	}
+	return pluginRequest{
+		Path:      r.URL.Path,
+		Query:     r.URL.RawQuery,
+		Host:      requestHost(r),
+		Method:    r.Method,
+		Scheme:    requestScheme(r),
+		ClientIP:  clientIP(r),
+		UserAgent: r.UserAgent(),
+		Headers:   headers,
+	}
+}
+
+func (p *wasmPlugin) decide(r *http.Request) (string, int, bool, error) {
+	in, err := json.Marshal(newPluginRequest(r))
+	if err != nil {
+		return "", 0, false, err
+	}
+
+	// the module is closed when the context is done, so instances must not
+	// be created with the request context
+	mod, _ := p.pool.Get().(api.Module)
+	if mod == nil {
+		if mod, err = p.instantiate(context.Background()); err != nil {
+			return "", 0, false, err
+		}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), wasmTimeout)
+	defer cancel()
+
+	out, err := p.call(ctx, mod, in)
+	if err != nil {
+		_ = mod.Close(context.Background())
+		return "", 0, false, fmt.Errorf("wasm plugin failed: %w", err)
+	}
+	p.pool.Put(mod)
+
+	if len(out) == 0 {
+		return "", 0, false, nil
+	}
+	var resp pluginResponse
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return "", 0, false, fmt.Errorf("invalid response from wasm plugin: %w", err)
+	}
+	if resp.Target == "" {
+		return "", 0, false, nil
+	}
+	if err := validateTarget(resp.Target); err != nil {
+		return "", 0, false, fmt.Errorf("wasm plugin returned an %w", err)
+	}
+	if resp.Status != 0 && !validRedirectStatus(resp.Status) {
+		return "", 0, false, fmt.Errorf("wasm plugin returned invalid status code %d", resp.Status)
+	}
+	return resp.Target, resp.Status, true, nil
+}
+
+func (p *wasmPlugin) call(ctx context.Context, mod api.Module, in []byte) ([]byte, error) {
+	res, err := mod.ExportedFunction("alloc").Call(ctx, uint64(len(in)))
+	if err != nil {
+		return nil, err
+	}
+	ptr := uint32(res[0])
+	if !mod.Memory().Write(ptr, in) {
+		return nil, fmt.Errorf("alloc returned an invalid pointer")
+	}
+	res, err = mod.ExportedFunction("redirect").Call(ctx, uint64(ptr), uint64(len(in)))
+	if err != nil {
+		return nil, err
+	}
+	if dealloc := mod.ExportedFunction("dealloc"); dealloc != nil {
+		if _, err := dealloc.Call(ctx, uint64(ptr), uint64(len(in))); err != nil {
+			return nil, err
+		}
+	}
+	outPtr, outLen := uint32(res[0]>>32), uint32(res[0])
+	if outLen == 0 {
+		return nil, nil
+	}
+	out, ok := mod.Memory().Read(outPtr, outLen)
+	if !ok {
+		return nil, fmt.Errorf("redirect returned an invalid pointer")
+	}
+	// the memory view is only valid until the next call
+	return append([]byte(nil), out...), nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// reloadDebounce collects the events of editors and config map updates
+// writing a file in several steps into a single reload
+const reloadDebounce = 500 * time.Millisecond
+
+// watchConfig reloads the config whenever the config, rules or an included
+// file changes.
+// The directories are watched instead of the files so replaced files and
+// Kubernetes config maps, which swap a ..data symlink, are picked up.
+func (app *application) watchConfig(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	patterns := app.watchFiles(watcher)
+	reload := time.NewTimer(reloadDebounce)
+	reload.Stop()
+	defer reload.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if watched(patterns, event.Name) {
+				reloadLog.Debugf("config change detected: %s", event)
+				reload.Reset(reloadDebounce)
+			}
+		case <-reload.C:
+			if err := app.reload(); err != nil {
+				reloadLog.Errorf("could not reload config, keeping the current one: %v", err)
+			}
+			// the config may reference another rules file now
+			patterns = app.watchFiles(watcher)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			reloadLog.Errorf("config watcher: %v", err)
+		}
+	}
+}
+
+// watchFiles adds the directories of the config, rules and included files
+// to the watcher and returns the patterns matching the files
+func (app *application) watchFiles(watcher *fsnotify.Watcher) []string {
+	cfg := app.config()
+	var patterns []string
+	for _, f := range append([]string{cfg.file, cfg.RulesFile}, cfg.includes...) {
+		if f == "" || isURL(f) {
+			continue
+		}
+		if err := watcher.Add(filepath.Dir(f)); err != nil {
+			reloadLog.Errorf("could not watch %s: %v", f, err)
+			continue
+		}
+		patterns = append(patterns, filepath.Clean(f))
+	}
+	return patterns
+}
+
+// watched reports if the changed file is one of the watched files
+func watched(patterns []string, name string) bool {
+	if filepath.Base(name) == "..data" {
+		return true
+	}
+	for _, p := range patterns {
+		if ok, _ := filepath.Match(p, filepath.Clean(name)); ok {
+			return true
+		}
+	}
+	return false
+}